@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type auditEntry struct {
+	Time       time.Time         `json:"time"`
+	Identity   string            `json:"identity"`
+	RemoteAddr string            `json:"remote_addr"`
+	Action     string            `json:"action"`
+	Params     map[string]string `json:"params,omitempty"`
+	Outcome    string            `json:"outcome"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// auditLog is an append-only JSON lines file. When the file grows beyond
+// maxBytes it is renamed to path.1 (shifting older files up to
+// path.maxBackups) and a new file is started.
+type auditLog struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File // nil if reopening after a rotation failed
+	size       int64
+}
+
+func newAuditLog(path string, maxBytes int64, maxBackups int) (*auditLog, error) {
+	a := &auditLog{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+func (a *auditLog) backupPath(n int) string {
+	return a.path + "." + strconv.Itoa(n)
+}
+
+// rotate starts a new file. If the old files cannot be moved, writing
+// continues in the current file. If the new file cannot be opened, a.file
+// is nil and the next write tries again.
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	a.file = nil
+	renameErr := a.shiftBackups()
+	if err := a.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func (a *auditLog) shiftBackups() error {
+	for n := a.maxBackups; n > 0; n-- {
+		source := a.path
+		if n > 1 {
+			source = a.backupPath(n - 1)
+		}
+		if err := os.Rename(source, a.backupPath(n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if a.maxBackups == 0 {
+		if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *auditLog) write(entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	if a.maxBytes > 0 && a.size+int64(len(line)) > a.maxBytes && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			logger.WithError(err).Error("Rotating audit log failed")
+			if a.file == nil {
+				return err
+			}
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// query returns the newest entries matching the filter, oldest first. Rotated
+// files are included so that the result does not depend on when the last
+// rotation happened. The files are opened under the lock and read without
+// it, so that writes do not wait for a query.
+func (a *auditLog) query(match func(auditEntry) bool, limit int) ([]auditEntry, error) {
+	files, err := a.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	// the last limit matches, entries[next] is the oldest once it is full
+	var entries []auditEntry
+	next := 0
+	for _, file := range files {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry auditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if !match(entry) {
+				continue
+			}
+			if limit <= 0 || len(entries) < limit {
+				entries = append(entries, entry)
+				continue
+			}
+			entries[next] = entry
+			next = (next + 1) % limit
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	ordered := make([]auditEntry, 0, len(entries))
+	ordered = append(ordered, entries[next:]...)
+	return append(ordered, entries[:next]...), nil
+}
+
+// snapshot opens the audit log files, oldest first. Files rotated while
+// they are read stay readable through the open handles.
+func (a *auditLog) snapshot() ([]*os.File, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var files []*os.File
+	for n := a.maxBackups; n >= 0; n-- {
+		path := a.path
+		if n > 0 {
+			path = a.backupPath(n)
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// check reports whether the audit log file is open and still in place.
+func (a *auditLog) check() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	_, err := os.Stat(a.path)
+	return err
+}
+
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	if err := a.file.Sync(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// audit records an action performed by the caller of the request. Failures
+// to write the audit log are logged but do not fail the request.
+func (s *server) audit(r *http.Request, action string, params map[string]string, actionErr error) {
+	identity, ok := Identity(r.Context())
+	if !ok {
+		identity = "anonymous"
+	}
+	entry := newAuditEntry(identity, action, params, actionErr)
+	entry.RemoteAddr = clientIP(r, s.trustedNetworks())
+	if err := s.auditLog.write(entry); err != nil {
+		requestLogger(r).WithError(err).Error("Writing audit log failed")
+	}
+}
+
+// auditSystem records an action the server performed on its own, e.g. an
+// automatic diff.
+func (s *server) auditSystem(identity string, action string, params map[string]string, actionErr error) {
+	if err := s.auditLog.write(newAuditEntry(identity, action, params, actionErr)); err != nil {
+		logger.WithError(err).Error("Writing audit log failed")
+	}
+}
+
+func newAuditEntry(identity string, action string, params map[string]string, actionErr error) auditEntry {
+	entry := auditEntry{
+		Time:     time.Now().UTC(),
+		Identity: identity,
+		Action:   action,
+		Params:   params,
+		Outcome:  "success",
+	}
+	if actionErr != nil {
+		entry.Outcome = "failure"
+		entry.Error = actionErr.Error()
+	}
+	return entry
+}
+
+func (s *server) handleAudit() http.HandlerFunc {
+	type response struct {
+		Entries []auditEntry `json:"entries"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		action := query.Get("action")
+		identity := query.Get("identity")
+		var since time.Time
+		if sinceString := query.Get("since"); sinceString != "" {
+			var err error
+			since, err = time.Parse(time.RFC3339, sinceString)
+			if err != nil {
+				respondErr(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		limit := 100
+		if limitString := query.Get("limit"); limitString != "" {
+			var err error
+			limit, err = strconv.Atoi(limitString)
+			if err != nil || limit < 1 {
+				respondErr(w, r, http.StatusBadRequest, fmt.Sprint("invalid limit: ", limitString))
+				return
+			}
+		}
+		s.audit(r, "admin.audit", map[string]string{
+			"action":   action,
+			"identity": identity,
+			"since":    query.Get("since"),
+		}, nil)
+		entries, err := s.auditLog.query(func(entry auditEntry) bool {
+			return (action == "" || entry.Action == action) &&
+				(identity == "" || entry.Identity == identity) &&
+				!entry.Time.Before(since)
+		}, limit)
+		if err != nil {
+			respondErr(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		respond(w, r, http.StatusOK, response{Entries: entries})
+	}
+}
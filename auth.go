@@ -5,14 +5,6 @@ import (
 	"net/http"
 )
 
-func withCORS(fn http.HandlerFunc, frontendOrigin string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", frontendOrigin)
-		w.Header().Set("Access-Control-Max-Age", "86400")
-		fn(w, r)
-	}
-}
-
 type contextKey struct {
 	name string
 }
@@ -31,12 +23,19 @@ func APIKey(ctx context.Context) (string, bool) {
 
 func withAPIKey(fn http.HandlerFunc, apiToken string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := Identity(r.Context()); ok {
+			// already authenticated by a signed request
+			fn(w, r)
+			return
+		}
 		key := r.Header.Get("api_token")
 		if !isValidAPIKey(key, apiToken) {
 			respondErr(w, r, http.StatusUnauthorized, "invalid API key")
 			return
 		}
 		ctx := context.WithValue(r.Context(), contextKeyAPIKey, key)
+		ctx = context.WithValue(ctx, contextKeyIdentity, "api-key")
+		setRequestIdentity(ctx, "api-key")
 		fn(w, r.WithContext(ctx))
 	}
 }
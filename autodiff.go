@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const autoDiffIdentity = "auto-diff"
+
+// tagWatcher remembers the tags of the projects in the groups with automatic
+// diffs. It is only used by runTagWatcher.
+type tagWatcher struct {
+	known     map[int]map[string]bool // matching tags per project ID
+	activity  map[int]time.Time       // last activity of the project when it was checked
+	triggered []time.Time             // automatic diffs within the last hour
+}
+
+func newTagWatcher() *tagWatcher {
+	return &tagWatcher{
+		known:    make(map[int]map[string]bool),
+		activity: make(map[int]time.Time),
+	}
+}
+
+// allow reports whether another automatic diff may be triggered this hour.
+func (t *tagWatcher) allow(now time.Time, maxPerHour int) bool {
+	recent := t.triggered[:0]
+	for _, triggeredAt := range t.triggered {
+		if now.Sub(triggeredAt) < time.Hour {
+			recent = append(recent, triggeredAt)
+		}
+	}
+	t.triggered = recent
+	return len(t.triggered) < maxPerHour
+}
+
+// requestTagCheck asks runTagWatcher to look for new tags without waiting
+// for it. A pending request is not repeated.
+func (s *server) requestTagCheck() {
+	select {
+	case s.tagCheck <- struct{}{}:
+	default:
+	}
+}
+
+// runTagWatcher checks for new tags whenever the projects have been
+// refreshed, so that the refresh does not wait for the tags of every
+// project. It returns once the server is shutting down.
+func (s *server) runTagWatcher() {
+	defer close(s.tagWatcherDone)
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case <-s.tagCheck:
+			s.checkNewTags()
+		}
+	}
+}
+
+// checkNewTags triggers a diff against the previous version for every new
+// tag matching tagPatterns in the groups listed in autoDiffGroups. Only
+// projects with activity since the last check, or with tags that could not
+// be diffed yet, are looked at. Tags that exist when a project is seen for
+// the first time, e.g. after a restart, do not count as new.
+func (s *server) checkNewTags() {
+	configuration := s.config()
+	if len(configuration.autoDiffGroups) == 0 {
+		return
+	}
+	if getPipelineProjectID() == 0 || !gitlabBreaker.allow() {
+		return
+	}
+	stateMu.RLock()
+	groupProjects := make(map[string][]gitlabProjectList)
+	for _, group := range configuration.autoDiffGroups {
+		groupProjects[group] = allProjects[group]
+	}
+	stateMu.RUnlock()
+
+	for group, projects := range groupProjects {
+		for _, project := range projects {
+			if s.shuttingDown() {
+				return
+			}
+			if project.LastActivityAt == nil {
+				continue
+			}
+			checkedActivity, checked := s.tagWatcher.activity[project.ID]
+			if checked && !project.LastActivityAt.After(checkedActivity) {
+				continue
+			}
+			pending, err := s.checkProjectTags(group, project)
+			if err != nil {
+				logger.WithError(err).WithFields(logrus.Fields{"group": group, "project": project.Name}).Error("Checking tags for automatic diffs failed")
+				continue
+			}
+			// look again on the next refresh if some tags are still waiting
+			// for their diff
+			if !pending {
+				s.tagWatcher.activity[project.ID] = *project.LastActivityAt
+			}
+		}
+	}
+}
+
+// checkProjectTags triggers the diffs for the new tags of a project and
+// reports whether some of them could not be triggered yet. A tag only counts
+// as known once its diff has been triggered or found in the history.
+func (s *server) checkProjectTags(group string, project gitlabProjectList) (bool, error) {
+	configuration := s.config()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(configuration.requestTimeoutSeconds)*time.Second)
+	defer cancel()
+	tagList, err := s.getTags(ctx, project.ID)
+	if err != nil {
+		return false, err
+	}
+	known := s.tagWatcher.known[project.ID]
+	baseline := known == nil
+	if baseline {
+		known = make(map[string]bool)
+		s.tagWatcher.known[project.ID] = known
+	}
+	pending := false
+	// the project path is used in the trigger, the name may differ
+	projectPath := path.Base(project.WebURL)
+	for _, version := range versionTimeline(tagList, configuration.tagPatterns) {
+		if !tagMatches(version.Name, configuration.tagPatterns) || known[version.Name] {
+			continue
+		}
+		if baseline || version.PreviousCommitID == "" || version.PreviousCommitID == version.CommitID {
+			known[version.Name] = true
+			continue
+		}
+		// no new pipelines once shutting down, they could not be recorded
+		if s.shuttingDown() {
+			pending = true
+			break
+		}
+		if s.triggerAutoDiff(ctx, group, projectPath, version) {
+			known[version.Name] = true
+		} else {
+			pending = true
+		}
+	}
+	return pending, nil
+}
+
+// triggerAutoDiff triggers the diff of a new tag against the previous
+// version and reports whether the diff exists now.
+func (s *server) triggerAutoDiff(ctx context.Context, group string, project string, version tagVersion) bool {
+	trigger := triggerStruct{
+		Group:   group,
+		Project: project,
+		SHA1:    version.PreviousCommitID,
+		SHA2:    version.CommitID,
+	}
+	diffLogger := logger.WithFields(logrus.Fields{"group": group, "project": project, "tag": version.Name, "previous": version.Previous})
+	if _, ok := s.history.find(group, project, trigger.SHA1, trigger.SHA2); ok {
+		diffLogger.Debug("Diff for new tag exists already")
+		return true
+	}
+	now := time.Now()
+	if !s.tagWatcher.allow(now, s.config().autoDiffMaxPerHour) {
+		diffLogger.Warn("Too many automatic diffs in the last hour, postponing new tag")
+		return false
+	}
+	auditParams := map[string]string{
+		"group":   group,
+		"project": project,
+		"sha1":    trigger.SHA1,
+		"sha2":    trigger.SHA2,
+		"tag":     version.Name,
+	}
+	pipeline, err := s.runDiffPipeline(ctx, trigger)
+	if err != nil {
+		s.auditSystem(autoDiffIdentity, "trigger", auditParams, err)
+		diffLogger.WithError(err).Error("Triggering automatic diff failed")
+		return false
+	}
+	s.tagWatcher.triggered = append(s.tagWatcher.triggered, now)
+	auditParams["pipeline_id"] = strconv.Itoa(pipeline.ID)
+	s.auditSystem(autoDiffIdentity, "trigger", auditParams, nil)
+	if err := s.history.add(historyEntry{
+		PipelineID:  pipeline.ID,
+		Group:       group,
+		Project:     project,
+		SHA1:        trigger.SHA1,
+		SHA2:        trigger.SHA2,
+		TriggeredAt: now.UTC(),
+		TriggeredBy: autoDiffIdentity,
+	}); err != nil {
+		diffLogger.WithError(err).Error("Recording diff in history failed")
+	}
+	diffLogger.WithField("pipeline_id", pipeline.ID).Info("Triggered automatic diff for new tag")
+	return true
+}
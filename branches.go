@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// sortBranches puts the default branch first and the others by the date of
+// their head commit, newest first.
+func sortBranches(branches []gitlabBranch) {
+	sort.SliceStable(branches, func(i, j int) bool {
+		a, b := branches[i], branches[j]
+		if a.Default != b.Default {
+			return a.Default
+		}
+		if a.CommittedDate != nil && b.CommittedDate != nil && !a.CommittedDate.Equal(*b.CommittedDate) {
+			return a.CommittedDate.After(*b.CommittedDate)
+		}
+		return a.Name < b.Name
+	})
+}
+
+func (s *server) handleBranches() http.HandlerFunc {
+	type response struct {
+		ProjectInfo gitlabProjectList `json:"project_info"`
+		Branches    []gitlabBranch    `json:"branches"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		projectGroup := vars["group"]
+		projectID := vars["id"]
+		requestLogger(r).WithFields(logrus.Fields{"group": projectGroup, "project": projectID}).Debug("Listing branches")
+		projectInfo, err := s.getProjectInfo(r.Context(), projectGroup, projectID)
+		if err != nil {
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		branchList, err := s.getBranches(r.Context(), projectInfo.ID)
+		if err != nil {
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		// the cached list is shared, sort a copy
+		branchList = append([]gitlabBranch{}, branchList...)
+		sortBranches(branchList)
+		branchesResponse := response{
+			ProjectInfo: projectInfo,
+			Branches:    branchList,
+		}
+		respond(w, r, http.StatusOK, branchesResponse)
+	}
+}
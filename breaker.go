@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// errGitLabUnavailable is returned without calling GitLab while the circuit
+// breaker is open.
+var errGitLabUnavailable = errors.New("GitLab is currently unavailable")
+
+// circuitBreaker stops calls to GitLab after repeated failures, so that
+// requests fail fast instead of waiting for timeouts. While it is open,
+// GitLab is probed periodically and the breaker closes again after the first
+// successful call.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	probeWait time.Duration
+	failures  int
+	open      bool
+	openedAt  time.Time
+}
+
+// gitlabBreaker guards all calls made through gitlabRequest. There is only
+// one GitLab client per process, so there is only one breaker.
+var gitlabBreaker = newCircuitBreaker(5, 30*time.Second)
+
+func newCircuitBreaker(threshold int, probeWait time.Duration) *circuitBreaker {
+	b := &circuitBreaker{}
+	b.configure(threshold, probeWait)
+	return b
+}
+
+func (b *circuitBreaker) configure(threshold int, probeWait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold = threshold
+	b.probeWait = probeWait
+}
+
+// allow reports whether calls to GitLab may be made.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open
+}
+
+// state returns whether the breaker is open and since when.
+func (b *circuitBreaker) state() (bool, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open, b.openedAt
+}
+
+func (b *circuitBreaker) interval() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.probeWait
+}
+
+// record updates the breaker with the result of a GitLab call. Only outages
+// count as failures, a missing project for example does not.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case err == nil:
+		if b.open {
+			logger.WithField("open_for", time.Since(b.openedAt).Round(time.Second)).Info("GitLab is available again, closing circuit breaker")
+		}
+		b.failures = 0
+		b.open = false
+		gitlabCircuitOpen.Set(0)
+	case isGitLabOutage(err):
+		b.failures++
+		if !b.open && b.failures >= b.threshold {
+			logger.WithError(err).WithField("failures", b.failures).Error("GitLab keeps failing, opening circuit breaker")
+			b.open = true
+			b.openedAt = time.Now()
+			gitlabCircuitOpen.Set(1)
+		}
+	}
+}
+
+// isGitLabOutage reports whether err means that GitLab could not serve the
+// call, as opposed to GitLab rejecting it.
+func isGitLabOutage(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if err == errGitLabTimeout || err == errGitLabUnavailable {
+		return true
+	}
+	var errResponse *gitlab.ErrorResponse
+	if errors.As(err, &errResponse) {
+		if errResponse.Response == nil {
+			return true
+		}
+		code := errResponse.Response.StatusCode
+		return code == http.StatusTooManyRequests || code >= 500
+	}
+	// connection errors
+	return true
+}
+
+// runBreakerProbe checks periodically whether GitLab is back while the
+// circuit breaker is open.
+func (s *server) runBreakerProbe() {
+	for {
+		timer := time.NewTimer(gitlabBreaker.interval())
+		select {
+		case <-s.stopping:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if open, _ := gitlabBreaker.state(); !open {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.config().gitlabTimeout("CurrentUser"))
+		done := observeGitLab("CurrentUser")
+		_, _, err := s.gl.Users.CurrentUser(gitlab.WithContext(ctx))
+		done(err)
+		cancel()
+		if err != nil {
+			logger.WithError(err).Warn("GitLab is still unavailable")
+		}
+		gitlabBreaker.record(err)
+	}
+}
+
+// requireGitLab rejects requests that cannot be served without GitLab while
+// the circuit breaker is open.
+func requireGitLab(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !gitlabBreaker.allow() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(gitlabBreaker.interval().Seconds())))
+			respondErr(w, r, http.StatusServiceUnavailable, errGitLabUnavailable, ", try again later")
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// lastKnownCache keeps the last successful response per key so that it can
+// be served while GitLab is unavailable. The keys contain the ref asked for
+// by the client, so the number of entries and their age are bounded.
+type lastKnownCache struct {
+	entries *lruCache
+}
+
+const (
+	lastKnownMaxEntries = 1000
+	lastKnownMaxAge     = 24 * time.Hour
+)
+
+type lastKnownEntry struct {
+	value    interface{}
+	storedAt time.Time
+}
+
+func newLastKnownCache() *lastKnownCache {
+	return &lastKnownCache{entries: newLRUCache(lastKnownMaxEntries, lastKnownMaxAge)}
+}
+
+func (c *lastKnownCache) store(key string, value interface{}) {
+	c.entries.add(key, lastKnownEntry{value: value, storedAt: time.Now()})
+}
+
+func (c *lastKnownCache) load(key string) (interface{}, time.Time, bool) {
+	cached, ok := c.entries.get(key)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	entry := cached.(lastKnownEntry)
+	return entry.value, entry.storedAt, true
+}
+
+const headerDataAge = "X-Data-Age"
+
+// setDataAge tells the client how old, in seconds, the data served from
+// the cache is.
+func setDataAge(w http.ResponseWriter, storedAt time.Time) {
+	w.Header().Set(headerDataAge, strconv.Itoa(int(time.Since(storedAt).Seconds())))
+}
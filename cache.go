@@ -0,0 +1,190 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// lruCache keeps recently fetched GitLab data for a short time, so that a
+// burst of requests for the same project costs one upstream fetch.
+type lruCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[string]*list.Element
+	order      *list.List // most recently used first
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRUCache(maxEntries int, ttl time.Duration) *lruCache {
+	c := &lruCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+	c.configure(maxEntries, ttl)
+	return c
+}
+
+func (c *lruCache) configure(maxEntries int, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxEntries = maxEntries
+	c.ttl = ttl
+	c.evict()
+}
+
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// add stores the value for key. Nothing is stored if caching is disabled
+// with a TTL of 0.
+func (c *lruCache) add(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 || c.maxEntries <= 0 {
+		return
+	}
+	expires := time.Now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	c.evict()
+}
+
+// evict drops the least recently used entries above the limit. Must be
+// called with c.mu held.
+func (c *lruCache) evict() {
+	for c.order.Len() > c.maxEntries {
+		element := c.order.Back()
+		c.order.Remove(element)
+		delete(c.entries, element.Value.(*lruEntry).key)
+	}
+}
+
+// fetchGroup coalesces concurrent fetches of the same key like
+// singleflight, but cancels a fetch once every caller waiting for it gave
+// up. The zero value is ready to use.
+type fetchGroup struct {
+	mu    sync.Mutex
+	calls map[string]*fetchCall
+}
+
+type fetchCall struct {
+	done    chan struct{} // closed once value and err are set
+	value   interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// join returns the fetch in flight for key, starting it with a context
+// limited to timeout if there is none, and counts the caller as waiting for
+// it. A new fetch logs with the request ID of ctx. The caller must call
+// leave if it stops waiting before the fetch is done.
+func (g *fetchGroup) join(ctx context.Context, key string, timeout time.Duration, fetch func(ctx context.Context) (interface{}, error)) (*fetchCall, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls == nil {
+		g.calls = make(map[string]*fetchCall)
+	}
+	call, shared := g.calls[key]
+	if !shared {
+		ctx, cancel := context.WithTimeout(detachContext(ctx), timeout)
+		call = &fetchCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+		go g.run(ctx, key, call, fetch)
+	}
+	call.waiters++
+	return call, shared
+}
+
+func (g *fetchGroup) run(ctx context.Context, key string, call *fetchCall, fetch func(ctx context.Context) (interface{}, error)) {
+	defer call.cancel()
+	value, err := fetch(ctx)
+	g.mu.Lock()
+	call.value, call.err = value, err
+	g.forget(key, call)
+	g.mu.Unlock()
+	close(call.done)
+}
+
+// leave stops waiting for a fetch and cancels it if nobody else waits.
+func (g *fetchGroup) leave(key string, call *fetchCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	call.waiters--
+	if call.waiters == 0 {
+		call.cancel()
+		// later callers start a new fetch instead of joining the canceled one
+		g.forget(key, call)
+	}
+}
+
+// forget removes the call unless it was replaced already. Must be called
+// with g.mu held.
+func (g *fetchGroup) forget(key string, call *fetchCall) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// cached returns the cached value for key or fetches it. Concurrent calls
+// for the same key share a single fetch. The fetch is not bound to the
+// context of a single caller, which would cancel it for everyone waiting,
+// but to the request timeout; it is canceled once the last caller waiting
+// for it gives up.
+func (s *server) cached(ctx context.Context, key string, fetch func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if value, ok := s.cache.get(key); ok {
+		cacheLookupsTotal.WithLabelValues("hit").Inc()
+		return value, nil
+	}
+	timeout := time.Duration(s.config().requestTimeoutSeconds) * time.Second
+	call, shared := s.flights.join(ctx, key, timeout, func(ctx context.Context) (interface{}, error) {
+		value, err := fetch(ctx)
+		if err == nil {
+			s.cache.add(key, value)
+		}
+		return value, err
+	})
+	select {
+	case <-call.done:
+		if shared {
+			cacheLookupsTotal.WithLabelValues("shared").Inc()
+		} else {
+			cacheLookupsTotal.WithLabelValues("miss").Inc()
+		}
+		return call.value, call.err
+	case <-ctx.Done():
+		s.flights.leave(key, call)
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errGitLabTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	c := newLRUCache(2, time.Minute)
+	c.add("a", 1)
+	c.add("b", 2)
+	// a becomes the most recently used entry, so b is evicted next
+	if value, ok := c.get("a"); !ok || value != 1 {
+		t.Fatalf("got %v, %v for a, want 1, true", value, ok)
+	}
+	c.add("c", 3)
+	if _, ok := c.get("b"); ok {
+		t.Error("b was not evicted")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if value, ok := c.get(key); !ok || value != want {
+			t.Errorf("got %v, %v for %s, want %d, true", value, ok, key, want)
+		}
+	}
+
+	c.add("a", 4)
+	if value, _ := c.get("a"); value != 4 {
+		t.Errorf("got %v for updated a, want 4", value)
+	}
+	if len(c.entries) != 2 || c.order.Len() != 2 {
+		t.Errorf("got %d entries and %d in order, want 2", len(c.entries), c.order.Len())
+	}
+
+	c.configure(1, time.Minute)
+	if _, ok := c.get("c"); ok {
+		t.Error("c was not evicted after lowering the limit")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("a was evicted after lowering the limit")
+	}
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	c := newLRUCache(10, 20*time.Millisecond)
+	c.add("a", 1)
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a expired too early")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Error("a did not expire")
+	}
+	if len(c.entries) != 0 || c.order.Len() != 0 {
+		t.Errorf("expired entry was not removed")
+	}
+}
+
+func TestLRUCacheDisabled(t *testing.T) {
+	for _, c := range []*lruCache{newLRUCache(10, 0), newLRUCache(0, time.Minute)} {
+		c.add("a", 1)
+		if _, ok := c.get("a"); ok {
+			t.Errorf("value stored with %d entries and TTL %s", c.maxEntries, c.ttl)
+		}
+		if len(c.entries) != 0 {
+			t.Errorf("got %d entries, want 0", len(c.entries))
+		}
+	}
+}
+
+func TestCachedCancelsAbandonedFetch(t *testing.T) {
+	s := &server{
+		cache:         newLRUCache(10, time.Minute),
+		configuration: &Configuration{requestTimeoutSeconds: 30},
+	}
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	fetch := func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	}
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() {
+		_, err := s.cached(first, "key", fetch)
+		errs <- err
+	}()
+	<-started
+	go func() {
+		_, err := s.cached(second, "key", func(ctx context.Context) (interface{}, error) {
+			t.Error("second caller did not share the fetch")
+			return nil, nil
+		})
+		errs <- err
+	}()
+	waitForWaiters(t, s, "key", 2)
+
+	cancelFirst()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("got %v for the first caller, want context.Canceled", err)
+	}
+	select {
+	case <-canceled:
+		t.Fatal("fetch was canceled while a caller was still waiting")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancelSecond()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("got %v for the second caller, want context.Canceled", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("fetch was not canceled after the last caller gave up")
+	}
+}
+
+func waitForWaiters(t *testing.T, s *server, key string, waiters int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		s.flights.mu.Lock()
+		call := s.flights.calls[key]
+		n := 0
+		if call != nil {
+			n = call.waiters
+		}
+		s.flights.mu.Unlock()
+		if n == waiters {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("got no fetch with %d waiters", waiters)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/xanzy/go-gitlab"
+)
+
+// checkGitLab verifies that GitLab is reachable with the configured token and
+// that the trigger token belongs to the pipeline project.
+func checkGitLab(configuration Configuration) configErrors {
+	var problems configErrors
+	gl, err := gitlab.NewClient(configuration.gitlabToken, gitlab.WithBaseURL(configuration.gitlabURL))
+	if err != nil {
+		problems.add("creating GitLab client: %v", err)
+		return problems
+	}
+	version, _, err := gl.Version.GetVersion()
+	if err != nil {
+		problems.add("GitLab is not reachable at %s: %v", configuration.gitlabURL, err)
+		return problems
+	}
+	fmt.Printf("GitLab version %s reachable at %s\n", version.Version, configuration.gitlabURL)
+
+	if _, err := validateSubgroups(context.Background(), tdrGroupID, gl, configuration); err != nil {
+		problems.add("groupIds: %v", err)
+	}
+
+	pipelineProject, _, err := gl.Projects.GetProject(pipelineProjectPath, nil)
+	if err != nil {
+		problems.add("pipeline project %s not accessible: %v", pipelineProjectPath, err)
+		return problems
+	}
+	triggers, _, err := gl.PipelineTriggers.ListPipelineTriggers(pipelineProject.ID, &gitlab.ListPipelineTriggersOptions{PerPage: 100})
+	if err != nil {
+		problems.add("cannot list triggers of %s to verify triggerToken: %v", pipelineProjectPath, err)
+		return problems
+	}
+	for _, trigger := range triggers {
+		if trigger.Token == configuration.triggerToken {
+			return problems
+		}
+	}
+	for _, trigger := range triggers {
+		// GitLab only shows the full token to the owner of the trigger
+		if len(trigger.Token) < len(configuration.triggerToken) && strings.HasPrefix(configuration.triggerToken, trigger.Token) {
+			fmt.Printf("Warning: triggerToken matches the visible part of trigger %d of %s\n", trigger.ID, pipelineProjectPath)
+			return problems
+		}
+	}
+	problems.add("triggerToken does not match any trigger of %s.", pipelineProjectPath)
+	return problems
+}
+
+// checkConfig prints the effective, redacted configuration and all problems
+// found. It returns the exit code for the --check-config flag.
+func checkConfig(v1 *viper.Viper) int {
+	configuration, err := validateAndSetConfig(v1)
+	printConfig(configuration)
+	var problems configErrors
+	if err != nil {
+		if configProblems, ok := err.(configErrors); ok {
+			problems = configProblems
+		} else {
+			problems.addErr(err)
+		}
+	} else {
+		problems = checkGitLab(configuration)
+	}
+	if len(problems) == 0 {
+		fmt.Println("Configuration OK")
+		return 0
+	}
+	fmt.Printf("Configuration has %d problem(s):\n", len(problems))
+	for _, problem := range problems {
+		fmt.Println("  -", problem)
+	}
+	return 1
+}
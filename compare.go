@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// changedFile is a file that differs between two commits.
+type changedFile struct {
+	Path      string `json:"path"`
+	OldPath   string `json:"old_path,omitempty"` // only for renamed files
+	Status    string `json:"status"`             // added, modified, deleted or renamed
+	Kind      string `json:"kind"`               // tex, figure, bibliography, style or other
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+// fileKinds maps file extensions to the kind of file in a TDR repository.
+var fileKinds = map[string]string{
+	".tex":  "tex",
+	".ltx":  "tex",
+	".bib":  "bibliography",
+	".bbl":  "bibliography",
+	".sty":  "style",
+	".cls":  "style",
+	".bst":  "style",
+	".pdf":  "figure",
+	".png":  "figure",
+	".jpg":  "figure",
+	".jpeg": "figure",
+	".eps":  "figure",
+	".ps":   "figure",
+	".gif":  "figure",
+	".svg":  "figure",
+}
+
+func fileKind(filePath string) string {
+	if kind, ok := fileKinds[strings.ToLower(path.Ext(filePath))]; ok {
+		return kind
+	}
+	return "other"
+}
+
+// countLines counts the added and deleted lines of a unified diff. Lines
+// before the first hunk header are file headers, so added lines starting
+// with "++" are still counted.
+func countLines(diff string) (int, int) {
+	additions, deletions := 0, 0
+	inHunk := false
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			inHunk = true
+		case !inHunk:
+		case strings.HasPrefix(line, "+"):
+			additions++
+		case strings.HasPrefix(line, "-"):
+			deletions++
+		}
+	}
+	return additions, deletions
+}
+
+func changedFiles(diffs []*gitlab.Diff) []changedFile {
+	files := make([]changedFile, 0, len(diffs))
+	for _, diff := range diffs {
+		file := changedFile{
+			Path:   diff.NewPath,
+			Status: "modified",
+		}
+		switch {
+		case diff.NewFile:
+			file.Status = "added"
+		case diff.DeletedFile:
+			file.Status = "deleted"
+			file.Path = diff.OldPath
+		case diff.RenamedFile:
+			file.Status = "renamed"
+			file.OldPath = diff.OldPath
+		}
+		file.Kind = fileKind(file.Path)
+		file.Additions, file.Deletions = countLines(diff.Diff)
+		files = append(files, file)
+	}
+	return files
+}
+
+func (s *server) handleCompare() http.HandlerFunc {
+	type response struct {
+		ProjectInfo gitlabProjectList  `json:"project_info"`
+		From        string             `json:"from"`
+		To          string             `json:"to"`
+		Files       []changedFile      `json:"files"`
+		CommitList  []gitlabCommitList `json:"commits"`
+		Truncated   bool               `json:"truncated"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		projectGroup := vars["group"]
+		projectID := vars["id"]
+		from := r.URL.Query().Get("from")
+		to := r.URL.Query().Get("to")
+		if from == "" || to == "" {
+			respondErr(w, r, http.StatusBadRequest, "from and to are required")
+			return
+		}
+		requestLogger(r).WithFields(logrus.Fields{"group": projectGroup, "project": projectID, "from": from, "to": to}).Debug("Comparing commits")
+		projectInfo, err := s.getProjectInfo(r.Context(), projectGroup, projectID)
+		if err != nil {
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		comparison, err := s.getComparison(r.Context(), projectInfo.ID, from, to)
+		if err != nil {
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		compareResponse := response{
+			ProjectInfo: projectInfo,
+			From:        from,
+			To:          to,
+			Files:       changedFiles(comparison.Diffs),
+			CommitList:  comparison.Commits,
+			Truncated:   comparison.TimedOut,
+		}
+		respond(w, r, http.StatusOK, compareResponse)
+	}
+}
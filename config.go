@@ -1,25 +1,66 @@
 package main
 
 import (
-	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 // Configuration structure
 type Configuration struct {
-	address               string
-	frontendOrigin        string
-	gitlabToken           string
-	triggerToken          string
-	apiToken              string
-	gitlabURL             string
-	gitlabProject         int
-	debug                 bool
-	groupIds              []string
-	commitHistoryDays     int
-	updateIntervalSeconds int
+	address                       string
+	frontendOrigin                string
+	allowedOrigins                []string
+	corsAllowCredentials          bool
+	gitlabToken                   string
+	triggerToken                  string
+	apiToken                      string
+	gitlabURL                     string
+	gitlabProject                 int
+	debug                         bool
+	logFormat                     string
+	groupIds                      []string
+	commitHistoryDays             int
+	updateIntervalSeconds         int
+	gitlabTimeoutSeconds          int
+	gitlabOperationTimeouts       map[string]int // seconds by lowercase operation name
+	requestTimeoutSeconds         int
+	gitlabRetryMax                int
+	gitlabRetryWaitMinMillis      int
+	gitlabRetryWaitMaxMillis      int
+	gitlabRateLimitReservePercent int
+	gitlabBreakerFailures         int
+	gitlabBreakerProbeSeconds     int
+	gitlabPageWorkers             int
+	gitlabMaxConcurrency          int
+	gitlabCacheSeconds            int
+	gitlabCacheMaxEntries         int
+	tagPatterns                   []string
+	autoDiffGroups                []string
+	autoDiffMaxPerHour            int
+	textDiffMaxBytes              int
+	shutdownTimeoutSeconds        int
+	shutdownDelaySeconds          int
+	hmacSecret                    string
+	hmacMaxSkewSeconds            int
+	auditLogPath                  string
+	auditLogMaxBytes              int64
+	auditLogMaxBackups            int
+	historyPath                   string
+	trustedProxies                []string
+	authMaxFailures               int
+	authLockoutSeconds            int
+	shareLinkSecret               string
+	shareLinkMaxHours             int
+	diffArtifactPath              string
 }
 
 func readConfig() (*viper.Viper, error) {
@@ -30,11 +71,43 @@ func readConfig() (*viper.Viper, error) {
 	// v.BindEnv("triggerToken")
 	v.SetDefault("address", ":8000")
 	v.SetDefault("frontendOrigin", "http://localhost:3000")
+	v.SetDefault("allowedOrigins", []string{})
+	v.SetDefault("corsAllowCredentials", false)
 	v.SetDefault("gitlabURL", "https://gitlab.cern.ch/api/v4")
 	v.SetDefault("gitlabProject", 56283)
 	v.SetDefault("debug", false)
+	v.SetDefault("logFormat", "logfmt")
 	v.SetDefault("commitHistoryDays", 90)
 	v.SetDefault("updateIntervalSeconds", 600)
+	v.SetDefault("shutdownTimeoutSeconds", 30)
+	v.SetDefault("shutdownDelaySeconds", 5)
+	v.SetDefault("gitlabTimeoutSeconds", 10)
+	v.SetDefault("gitlabOperationTimeouts", map[string]int{})
+	v.SetDefault("requestTimeoutSeconds", 30)
+	v.SetDefault("gitlabRetryMax", 3)
+	v.SetDefault("gitlabRetryWaitMinMillis", 500)
+	v.SetDefault("gitlabRetryWaitMaxMillis", 10000)
+	v.SetDefault("gitlabRateLimitReservePercent", 20)
+	v.SetDefault("gitlabBreakerFailures", 5)
+	v.SetDefault("gitlabBreakerProbeSeconds", 30)
+	v.SetDefault("gitlabPageWorkers", 4)
+	v.SetDefault("gitlabMaxConcurrency", 8)
+	v.SetDefault("gitlabCacheSeconds", 30)
+	v.SetDefault("gitlabCacheMaxEntries", 500)
+	v.SetDefault("tagPatterns", []string{"CADI-BuildTag*"})
+	v.SetDefault("autoDiffGroups", []string{})
+	v.SetDefault("autoDiffMaxPerHour", 10)
+	v.SetDefault("textDiffMaxBytes", 1<<20)
+	v.SetDefault("hmacMaxSkewSeconds", 300)
+	v.SetDefault("auditLogPath", "audit.log")
+	v.SetDefault("auditLogMaxBytes", 10*1024*1024)
+	v.SetDefault("auditLogMaxBackups", 5)
+	v.SetDefault("historyPath", "history.jsonl")
+	v.SetDefault("trustedProxies", []string{})
+	v.SetDefault("authMaxFailures", 10)
+	v.SetDefault("authLockoutSeconds", 900)
+	v.SetDefault("shareLinkMaxHours", 168)
+	v.SetDefault("diffArtifactPath", "diff.pdf")
 	v.SetDefault("groupIds", []string{
 		"papers", "notes", "reports",
 		// "reports",
@@ -46,55 +119,305 @@ func readConfig() (*viper.Viper, error) {
 	if err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
 			// Config file not found; ignore error if desired
-			fmt.Println("Config file not found. Trying to use environment variables.")
+			logger.Info("Config file not found, trying to use environment variables")
 			return v, nil
 		}
 	}
 	return v, err
 }
 
+// readSecret returns the value of key, or the trimmed contents of the file
+// given by keyFile, e.g. gitlabTokenFile for secrets mounted in OpenShift.
+func readSecret(v1 *viper.Viper, key string) (string, error) {
+	value := v1.GetString(key)
+	filePath := v1.GetString(key + "File")
+	if filePath == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("only one of %s and %sFile can be set", key, key)
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("reading %sFile: %v", key, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// configErrors collects all problems found in a configuration.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+func (e *configErrors) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+func (e *configErrors) addErr(err error) {
+	if err != nil {
+		*e = append(*e, err.Error())
+	}
+}
+
+func (e *configErrors) checkURL(key, value string) {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		e.add("%s must be an http(s) URL, got %q.", key, value)
+	}
+}
+
+func (e *configErrors) checkPositive(key string, value int64) {
+	if value <= 0 {
+		e.add("%s must be positive, got %d.", key, value)
+	}
+}
+
+func (e *configErrors) checkNotNegative(key string, value int64) {
+	if value < 0 {
+		e.add("%s cannot be negative, got %d.", key, value)
+	}
+}
+
 func validateAndSetConfig(v1 *viper.Viper) (Configuration, error) {
 	var configuration Configuration
+	var problems configErrors
+	var err error
 	configuration.address = v1.GetString("address")
 	configuration.frontendOrigin = v1.GetString("frontendOrigin")
+	configuration.allowedOrigins = v1.GetStringSlice("allowedOrigins")
+	configuration.corsAllowCredentials = v1.GetBool("corsAllowCredentials")
 	configuration.gitlabURL = v1.GetString("gitlabURL")
 	configuration.gitlabProject = v1.GetInt("gitlabProject")
 	configuration.debug = v1.GetBool("debug")
+	configuration.logFormat = v1.GetString("logFormat")
 	configuration.groupIds = v1.GetStringSlice("groupIds")
 	configuration.commitHistoryDays = v1.GetInt("commitHistoryDays")
 	configuration.updateIntervalSeconds = v1.GetInt("updateIntervalSeconds")
-	configuration.gitlabToken = v1.GetString("gitlabToken")
+	configuration.shutdownTimeoutSeconds = v1.GetInt("shutdownTimeoutSeconds")
+	configuration.shutdownDelaySeconds = v1.GetInt("shutdownDelaySeconds")
+	configuration.gitlabTimeoutSeconds = v1.GetInt("gitlabTimeoutSeconds")
+	configuration.requestTimeoutSeconds = v1.GetInt("requestTimeoutSeconds")
+	configuration.gitlabRetryMax = v1.GetInt("gitlabRetryMax")
+	configuration.gitlabRetryWaitMinMillis = v1.GetInt("gitlabRetryWaitMinMillis")
+	configuration.gitlabRetryWaitMaxMillis = v1.GetInt("gitlabRetryWaitMaxMillis")
+	configuration.gitlabRateLimitReservePercent = v1.GetInt("gitlabRateLimitReservePercent")
+	configuration.gitlabBreakerFailures = v1.GetInt("gitlabBreakerFailures")
+	configuration.gitlabBreakerProbeSeconds = v1.GetInt("gitlabBreakerProbeSeconds")
+	configuration.gitlabPageWorkers = v1.GetInt("gitlabPageWorkers")
+	configuration.gitlabMaxConcurrency = v1.GetInt("gitlabMaxConcurrency")
+	configuration.gitlabCacheSeconds = v1.GetInt("gitlabCacheSeconds")
+	configuration.gitlabCacheMaxEntries = v1.GetInt("gitlabCacheMaxEntries")
+	configuration.tagPatterns = v1.GetStringSlice("tagPatterns")
+	configuration.autoDiffGroups = v1.GetStringSlice("autoDiffGroups")
+	configuration.autoDiffMaxPerHour = v1.GetInt("autoDiffMaxPerHour")
+	configuration.textDiffMaxBytes = v1.GetInt("textDiffMaxBytes")
+	configuration.hmacMaxSkewSeconds = v1.GetInt("hmacMaxSkewSeconds")
+	configuration.auditLogPath = v1.GetString("auditLogPath")
+	configuration.auditLogMaxBytes = v1.GetInt64("auditLogMaxBytes")
+	configuration.auditLogMaxBackups = v1.GetInt("auditLogMaxBackups")
+	configuration.historyPath = v1.GetString("historyPath")
+	configuration.trustedProxies = v1.GetStringSlice("trustedProxies")
+	configuration.authMaxFailures = v1.GetInt("authMaxFailures")
+	configuration.authLockoutSeconds = v1.GetInt("authLockoutSeconds")
+	configuration.shareLinkMaxHours = v1.GetInt("shareLinkMaxHours")
+	configuration.diffArtifactPath = v1.GetString("diffArtifactPath")
 
-	if configuration.gitlabToken == "" {
-		errorMessage := "gitlabToken cannot be empty."
-		err := errors.New(errorMessage)
-		return configuration, err
+	configuration.gitlabOperationTimeouts = make(map[string]int)
+	for operation, value := range v1.GetStringMapString("gitlabOperationTimeouts") {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			problems.add("gitlabOperationTimeouts.%s must be a positive number of seconds, got %q.", operation, value)
+			continue
+		}
+		configuration.gitlabOperationTimeouts[strings.ToLower(operation)] = seconds
 	}
 
-	configuration.triggerToken = v1.GetString("triggerToken")
+	configuration.gitlabToken, err = readSecret(v1, "gitlabToken")
+	problems.addErr(err)
+	configuration.triggerToken, err = readSecret(v1, "triggerToken")
+	problems.addErr(err)
+	configuration.apiToken, err = readSecret(v1, "apiToken")
+	problems.addErr(err)
+	configuration.hmacSecret, err = readSecret(v1, "hmacSecret")
+	problems.addErr(err)
+	configuration.shareLinkSecret, err = readSecret(v1, "shareLinkSecret")
+	problems.addErr(err)
+
+	if configuration.gitlabToken == "" {
+		problems.add("gitlabToken cannot be empty.")
+	}
 	if configuration.triggerToken == "" {
-		errorMessage := "triggerToken cannot be empty."
-		err := errors.New(errorMessage)
-		return configuration, err
+		problems.add("triggerToken cannot be empty.")
 	}
-
-	configuration.apiToken = v1.GetString("apiToken")
 	if configuration.apiToken == "" {
-		errorMessage := "apiToken cannot be empty."
-		err := errors.New(errorMessage)
-		return configuration, err
-	}
-
-	fmt.Printf("Reading config for address = %s\n", configuration.address)
-	fmt.Printf("Reading config for frontendOrigin = %s\n", configuration.frontendOrigin)
-	fmt.Printf("Reading config for gitlabURL = %s\n", configuration.gitlabURL)
-	fmt.Printf("Reading config for gitlabProject = %d\n", configuration.gitlabProject)
-	fmt.Printf("Reading config for debug = %t\n", configuration.debug)
-	fmt.Printf("Reading config for groupIds = %#v\n", configuration.groupIds)
-	fmt.Printf("Reading config for commitHistoryDays = %d\n", configuration.commitHistoryDays)
-	fmt.Printf("Reading config for updateIntervalSeconds = %d\n", configuration.updateIntervalSeconds)
-	// fmt.Printf("Reading config for gitlabToken = %s\n", configuration.gitlabToken)
-	// fmt.Printf("Reading config for triggerToken = %s\n", configuration.triggerToken)
-	// fmt.Printf("Reading config for apiToken = %s\n", configuration.apiToken)
+		problems.add("apiToken cannot be empty.")
+	}
+	if len(configuration.groupIds) == 0 {
+		problems.add("groupIds cannot be empty.")
+	}
+	if configuration.logFormat != "logfmt" && configuration.logFormat != "json" {
+		problems.add("logFormat must be logfmt or json, got %q.", configuration.logFormat)
+	}
+	if configuration.auditLogPath == "" {
+		problems.add("auditLogPath cannot be empty.")
+	}
+	if configuration.historyPath == "" {
+		problems.add("historyPath cannot be empty.")
+	}
+	problems.checkURL("gitlabURL", configuration.gitlabURL)
+	problems.checkURL("frontendOrigin", configuration.frontendOrigin)
+	// browsers would send cookies and credentials from any matching site
+	if configuration.corsAllowCredentials {
+		if !isSpecificOrigin(configuration.frontendOrigin) {
+			problems.add("frontendOrigin: %q is not a fixed domain, which cannot be combined with corsAllowCredentials.", configuration.frontendOrigin)
+		}
+		for _, origin := range configuration.allowedOrigins {
+			if !isSpecificOrigin(origin) {
+				problems.add("allowedOrigins: %q is not a fixed domain optionally prefixed with *., which cannot be combined with corsAllowCredentials.", origin)
+			}
+		}
+	}
+	problems.checkPositive("commitHistoryDays", int64(configuration.commitHistoryDays))
+	problems.checkPositive("updateIntervalSeconds", int64(configuration.updateIntervalSeconds))
+	problems.checkPositive("shutdownTimeoutSeconds", int64(configuration.shutdownTimeoutSeconds))
+	problems.checkNotNegative("shutdownDelaySeconds", int64(configuration.shutdownDelaySeconds))
+	problems.checkPositive("gitlabTimeoutSeconds", int64(configuration.gitlabTimeoutSeconds))
+	problems.checkPositive("requestTimeoutSeconds", int64(configuration.requestTimeoutSeconds))
+	// go-gitlab gives up after 5 retries regardless of the retry policy
+	if configuration.gitlabRetryMax < 0 || configuration.gitlabRetryMax > 5 {
+		problems.add("gitlabRetryMax must be between 0 and 5, got %d.", configuration.gitlabRetryMax)
+	}
+	problems.checkPositive("gitlabRetryWaitMinMillis", int64(configuration.gitlabRetryWaitMinMillis))
+	if configuration.gitlabRetryWaitMaxMillis < configuration.gitlabRetryWaitMinMillis {
+		problems.add("gitlabRetryWaitMaxMillis must not be less than gitlabRetryWaitMinMillis, got %d.", configuration.gitlabRetryWaitMaxMillis)
+	}
+	problems.checkPositive("gitlabBreakerFailures", int64(configuration.gitlabBreakerFailures))
+	problems.checkPositive("gitlabBreakerProbeSeconds", int64(configuration.gitlabBreakerProbeSeconds))
+	problems.checkPositive("gitlabPageWorkers", int64(configuration.gitlabPageWorkers))
+	problems.checkPositive("gitlabMaxConcurrency", int64(configuration.gitlabMaxConcurrency))
+	problems.checkNotNegative("gitlabCacheSeconds", int64(configuration.gitlabCacheSeconds))
+	problems.checkNotNegative("gitlabCacheMaxEntries", int64(configuration.gitlabCacheMaxEntries))
+	for _, pattern := range configuration.tagPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			problems.add("tagPatterns: invalid pattern %q.", pattern)
+		}
+	}
+	for _, group := range configuration.autoDiffGroups {
+		found := false
+		for _, configuredGroup := range configuration.groupIds {
+			found = found || group == configuredGroup
+		}
+		if !found {
+			problems.add("autoDiffGroups: %q is not one of groupIds.", group)
+		}
+	}
+	problems.checkPositive("autoDiffMaxPerHour", int64(configuration.autoDiffMaxPerHour))
+	problems.checkPositive("textDiffMaxBytes", int64(configuration.textDiffMaxBytes))
+	if configuration.gitlabRateLimitReservePercent < 0 || configuration.gitlabRateLimitReservePercent > 100 {
+		problems.add("gitlabRateLimitReservePercent must be between 0 and 100, got %d.", configuration.gitlabRateLimitReservePercent)
+	}
+	problems.checkPositive("hmacMaxSkewSeconds", int64(configuration.hmacMaxSkewSeconds))
+	problems.checkNotNegative("auditLogMaxBytes", configuration.auditLogMaxBytes)
+	problems.checkNotNegative("auditLogMaxBackups", int64(configuration.auditLogMaxBackups))
+	problems.checkPositive("authMaxFailures", int64(configuration.authMaxFailures))
+	problems.checkPositive("authLockoutSeconds", int64(configuration.authLockoutSeconds))
+	problems.checkPositive("shareLinkMaxHours", int64(configuration.shareLinkMaxHours))
+	if _, err := parseTrustedProxies(configuration.trustedProxies); err != nil {
+		problems.add("trustedProxies: %v", err)
+	}
+	if len(problems) > 0 {
+		return configuration, problems
+	}
+
 	return configuration, nil
 }
+
+// gitlabTimeout returns the timeout for a single call of the given GitLab
+// operation, e.g. ListCommits.
+func (configuration *Configuration) gitlabTimeout(operation string) time.Duration {
+	if seconds, ok := configuration.gitlabOperationTimeouts[strings.ToLower(operation)]; ok {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(configuration.gitlabTimeoutSeconds) * time.Second
+}
+
+// gitlabRetryWait returns the minimum and maximum wait between retries of
+// GitLab calls.
+func (configuration *Configuration) gitlabRetryWait() (time.Duration, time.Duration) {
+	return time.Duration(configuration.gitlabRetryWaitMinMillis) * time.Millisecond,
+		time.Duration(configuration.gitlabRetryWaitMaxMillis) * time.Millisecond
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return "<not set>"
+	}
+	return "<redacted>"
+}
+
+// configFields returns the configuration with redacted secrets, for logging
+// and --check-config.
+func configFields(configuration Configuration) logrus.Fields {
+	return logrus.Fields{
+		"address":                       configuration.address,
+		"frontendOrigin":                configuration.frontendOrigin,
+		"allowedOrigins":                configuration.allowedOrigins,
+		"corsAllowCredentials":          configuration.corsAllowCredentials,
+		"gitlabURL":                     configuration.gitlabURL,
+		"gitlabProject":                 configuration.gitlabProject,
+		"debug":                         configuration.debug,
+		"logFormat":                     configuration.logFormat,
+		"groupIds":                      configuration.groupIds,
+		"commitHistoryDays":             configuration.commitHistoryDays,
+		"updateIntervalSeconds":         configuration.updateIntervalSeconds,
+		"shutdownTimeoutSeconds":        configuration.shutdownTimeoutSeconds,
+		"shutdownDelaySeconds":          configuration.shutdownDelaySeconds,
+		"gitlabTimeoutSeconds":          configuration.gitlabTimeoutSeconds,
+		"gitlabOperationTimeouts":       configuration.gitlabOperationTimeouts,
+		"requestTimeoutSeconds":         configuration.requestTimeoutSeconds,
+		"gitlabRetryMax":                configuration.gitlabRetryMax,
+		"gitlabRetryWaitMinMillis":      configuration.gitlabRetryWaitMinMillis,
+		"gitlabRetryWaitMaxMillis":      configuration.gitlabRetryWaitMaxMillis,
+		"gitlabRateLimitReservePercent": configuration.gitlabRateLimitReservePercent,
+		"gitlabBreakerFailures":         configuration.gitlabBreakerFailures,
+		"gitlabBreakerProbeSeconds":     configuration.gitlabBreakerProbeSeconds,
+		"gitlabPageWorkers":             configuration.gitlabPageWorkers,
+		"gitlabMaxConcurrency":          configuration.gitlabMaxConcurrency,
+		"gitlabCacheSeconds":            configuration.gitlabCacheSeconds,
+		"gitlabCacheMaxEntries":         configuration.gitlabCacheMaxEntries,
+		"tagPatterns":                   configuration.tagPatterns,
+		"autoDiffGroups":                configuration.autoDiffGroups,
+		"autoDiffMaxPerHour":            configuration.autoDiffMaxPerHour,
+		"textDiffMaxBytes":              configuration.textDiffMaxBytes,
+		"hmacMaxSkewSeconds":            configuration.hmacMaxSkewSeconds,
+		"auditLogPath":                  configuration.auditLogPath,
+		"auditLogMaxBytes":              configuration.auditLogMaxBytes,
+		"auditLogMaxBackups":            configuration.auditLogMaxBackups,
+		"historyPath":                   configuration.historyPath,
+		"trustedProxies":                configuration.trustedProxies,
+		"authMaxFailures":               configuration.authMaxFailures,
+		"authLockoutSeconds":            configuration.authLockoutSeconds,
+		"shareLinkMaxHours":             configuration.shareLinkMaxHours,
+		"diffArtifactPath":              configuration.diffArtifactPath,
+		"gitlabToken":                   redact(configuration.gitlabToken),
+		"triggerToken":                  redact(configuration.triggerToken),
+		"apiToken":                      redact(configuration.apiToken),
+		"hmacSecret":                    redact(configuration.hmacSecret),
+		"shareLinkSecret":               redact(configuration.shareLinkSecret),
+	}
+}
+
+// printConfig prints the redacted configuration, sorted by key.
+func printConfig(configuration Configuration) {
+	fields := configFields(configuration)
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%s = %v\n", key, fields[key])
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+var (
+	corsAllowedMethods = []string{"GET", "POST", "OPTIONS"}
+	corsAllowedHeaders = []string{
+		"Content-Type", "api_token", headerRequestID,
+		headerClientID, headerTimestamp, headerNonce, headerSignature,
+	}
+	corsExposedHeaders = []string{"Retry-After", headerRequestID, headerDataAge}
+)
+
+// corsPolicy decides which origins may access the API from a browser.
+// Origins may contain shell-style wildcards, e.g. https://*.web.cern.ch.
+type corsPolicy struct {
+	mu               sync.RWMutex
+	origins          []string
+	allowCredentials bool
+}
+
+func newCORSPolicy(frontendOrigin string, allowedOrigins []string, allowCredentials bool) *corsPolicy {
+	p := &corsPolicy{}
+	p.configure(frontendOrigin, allowedOrigins, allowCredentials)
+	return p
+}
+
+func (p *corsPolicy) configure(frontendOrigin string, allowedOrigins []string, allowCredentials bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.origins = append([]string{frontendOrigin}, allowedOrigins...)
+	p.allowCredentials = allowCredentials
+}
+
+func (p *corsPolicy) credentials() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.allowCredentials
+}
+
+func (p *corsPolicy) allowed(origin string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, pattern := range p.origins {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		if matched, err := path.Match(pattern, origin); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isSpecificOrigin reports whether an origin pattern only matches the sites
+// of one domain: an http(s) origin whose host is a fixed domain, optionally
+// prefixed with "*." to match its subdomains. Patterns like https://*.com or
+// *://* match arbitrary sites.
+func isSpecificOrigin(pattern string) bool {
+	u, err := url.Parse(pattern)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil ||
+		(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return false
+	}
+	host := u.Host
+	wildcard := strings.HasPrefix(host, "*.")
+	if wildcard {
+		host = strings.TrimPrefix(host, "*.")
+	}
+	if host == "" || strings.ContainsAny(host, `*?[]\`) {
+		return false
+	}
+	domain := strings.Split(host, ":")[0]
+	return !wildcard || strings.Contains(domain, ".")
+}
+
+// withCORS sets the CORS headers for all routes and answers preflight
+// requests before they reach the router, so that neither route methods nor
+// authentication get in the way of the browser.
+func withCORS(h http.Handler, policy *corsPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !policy.allowed(origin) {
+			if preflight {
+				respondErr(w, r, http.StatusForbidden, "origin not allowed: ", origin)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if policy.credentials() {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(corsAllowedMethods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
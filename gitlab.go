@@ -1,13 +1,94 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"log"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/sirupsen/logrus"
 	"github.com/xanzy/go-gitlab"
 )
 
+// errGitLabTimeout is returned when GitLab did not answer within the
+// configured timeout or before the request deadline.
+var errGitLabTimeout = errors.New("GitLab did not respond in time")
+
+// gitlabRequest prepares a call of a GitLab operation. The returned option
+// binds the call to ctx and the timeout configured for the operation. The
+// returned function must be called with the result of the call; it records
+// metrics, turns timeouts into errGitLabTimeout and updates the circuit
+// breaker. While the breaker is open, the call fails with
+// errGitLabUnavailable without reaching GitLab. At most gitlabConcurrency
+// calls run at the same time, waiting for a slot counts towards the timeout.
+func gitlabRequest(ctx context.Context, configuration *Configuration, operation string) (gitlab.RequestOptionFunc, func(error) error) {
+	if !gitlabBreaker.allow() {
+		reject := func(*retryablehttp.Request) error {
+			return errGitLabUnavailable
+		}
+		return reject, func(err error) error {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, configuration.gitlabTimeout(operation))
+	if err := gitlabConcurrency.Acquire(ctx, 1); err != nil {
+		cancel()
+		if err == context.DeadlineExceeded {
+			err = errGitLabTimeout
+		}
+		reject := func(*retryablehttp.Request) error {
+			return err
+		}
+		return reject, func(err error) error {
+			return err
+		}
+	}
+	ctx = context.WithValue(ctx, contextKeyGitLabCall, &gitlabCall{operation: operation})
+	observe := observeGitLab(operation)
+	return gitlab.WithContext(ctx), func(err error) error {
+		defer cancel()
+		defer gitlabConcurrency.Release(1)
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			err = errGitLabTimeout
+		}
+		observe(err)
+		gitlabBreaker.record(err)
+		return err
+	}
+}
+
+func (s *server) gitlabRequest(ctx context.Context, operation string) (gitlab.RequestOptionFunc, func(error) error) {
+	return gitlabRequest(ctx, s.config(), operation)
+}
+
+// gitlabErrStatus returns the status to respond with when a GitLab call
+// failed: 504 for timeouts, 503 if GitLab is unavailable or rate limits us,
+// 502 if GitLab failed, otherwise the given status.
+func gitlabErrStatus(err error, status int) int {
+	if err == errGitLabTimeout {
+		return http.StatusGatewayTimeout
+	}
+	if err == errGitLabUnavailable {
+		return http.StatusServiceUnavailable
+	}
+	var errResponse *gitlab.ErrorResponse
+	if errors.As(err, &errResponse) && errResponse.Response != nil {
+		switch code := errResponse.Response.StatusCode; {
+		case code == http.StatusTooManyRequests:
+			return http.StatusServiceUnavailable
+		case code >= 500:
+			return http.StatusBadGateway
+		}
+	}
+	return status
+}
+
 type gitlabProjectList struct {
 	ID             int        `json:"id"`
 	Name           string     `json:"name"`
@@ -16,11 +97,23 @@ type gitlabProjectList struct {
 	Description    string     `json:"description"`
 }
 
-func (s *server) getProjectInfo(projectGroup string, projectID string) (gitlabProjectList, *gitlab.Response, error) {
+func (s *server) getProjectInfo(ctx context.Context, projectGroup string, projectID string) (gitlabProjectList, error) {
 	projectPath := "tdr/" + projectGroup + "/" + projectID
-	project, response, err := s.gl.Projects.GetProject(projectPath, nil)
+	value, err := s.cached(ctx, "project/"+projectPath, func(ctx context.Context) (interface{}, error) {
+		return s.fetchProjectInfo(ctx, projectPath)
+	})
 	if err != nil {
-		return gitlabProjectList{}, response, err
+		return gitlabProjectList{}, err
+	}
+	return value.(gitlabProjectList), nil
+}
+
+func (s *server) fetchProjectInfo(ctx context.Context, projectPath string) (gitlabProjectList, error) {
+	withContext, done := s.gitlabRequest(ctx, "GetProject")
+	project, _, err := s.gl.Projects.GetProject(projectPath, nil, withContext)
+	err = done(err)
+	if err != nil {
+		return gitlabProjectList{}, err
 	}
 	projectInfo := gitlabProjectList{
 		ID:             project.ID,
@@ -29,23 +122,39 @@ func (s *server) getProjectInfo(projectGroup string, projectID string) (gitlabPr
 		WebURL:         project.WebURL,
 		LastActivityAt: project.LastActivityAt,
 	}
-	return projectInfo, response, err
+	return projectInfo, nil
 }
 
-func (s *server) getCommits(projectID int) ([]gitlabCommitList, error) {
-	maxPages := 100
-	currentPage := 1
-	var commitList []gitlabCommitList
-	for currentPage <= maxPages {
+// getCommits lists the commits of a branch, tag or commit. An empty ref
+// stands for the default branch.
+func (s *server) getCommits(ctx context.Context, projectID int, ref string) ([]gitlabCommitList, error) {
+	value, err := s.cached(ctx, "commits/"+strconv.Itoa(projectID)+"?ref="+ref, func(ctx context.Context) (interface{}, error) {
+		return s.fetchCommits(ctx, projectID, ref)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// handlers modify the commits, so every caller gets its own copy
+	return append([]gitlabCommitList(nil), value.([]gitlabCommitList)...), nil
+}
+
+func (s *server) fetchCommits(ctx context.Context, projectID int, ref string) ([]gitlabCommitList, error) {
+	var mu sync.Mutex
+	pages := make(map[int][]gitlabCommitList)
+	err := fetchPages(ctx, 100, s.config().gitlabPageWorkers, func(ctx context.Context, page int) (int, error) {
 		var listQueryOptions = &gitlab.ListCommitsOptions{
 			ListOptions: gitlab.ListOptions{
 				PerPage: 100, // this is the maximum one can ask for
-				Page:    currentPage,
+				Page:    page,
 			}}
-		commits, response, err := s.gl.Commits.ListCommits(projectID, listQueryOptions)
+		if ref != "" {
+			listQueryOptions.RefName = gitlab.String(ref)
+		}
+		withContext, done := s.gitlabRequest(ctx, "ListCommits")
+		commits, response, err := s.gl.Commits.ListCommits(projectID, listQueryOptions, withContext)
+		err = done(err)
 		if err != nil {
-			log.Print(err)
-			return commitList, err
+			return 0, err
 		}
 		currentCommitList := make([]gitlabCommitList, len(commits))
 		for i := 0; i < len(commits); i++ {
@@ -57,35 +166,344 @@ func (s *server) getCommits(projectID int) ([]gitlabCommitList, error) {
 				AuthorName:  commits[i].AuthorName,
 				AuthorEmail: commits[i].AuthorEmail,
 				Tag:         string(""),
+				Tags:        []string{},
 			}
-			commitList = append(commitList, currentCommitList[i])
 		}
-		maxPages = response.TotalPages
-		currentPage++
+		mu.Lock()
+		pages[page] = currentCommitList
+		mu.Unlock()
+		return response.TotalPages, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var commitList []gitlabCommitList
+	for page := 1; page <= len(pages); page++ {
+		commitList = append(commitList, pages[page]...)
 	}
-	log.Println("Number of commits:", len(commitList))
 	return commitList, nil
 }
 
-func (s *server) getTags(projectID int) ([]*gitlab.Tag, error) {
+// gitlabBranch describes a branch and its head commit.
+type gitlabBranch struct {
+	Name          string     `json:"name"`
+	Default       bool       `json:"default"`
+	Protected     bool       `json:"protected"`
+	Merged        bool       `json:"merged"`
+	CommitID      string     `json:"commit_id"`
+	ShortID       string     `json:"short_id"`
+	CommitTitle   string     `json:"commit_title"`
+	CommitAuthor  string     `json:"commit_author"`
+	CommittedDate *time.Time `json:"committed_date"`
+}
 
-	// var tagList []gitlabTagList
-	var listQueryOptions = &gitlab.ListTagsOptions{
-		ListOptions: gitlab.ListOptions{}}
-	tags, _, err := s.gl.Tags.ListTags(projectID, listQueryOptions)
+func (s *server) getBranches(ctx context.Context, projectID int) ([]gitlabBranch, error) {
+	value, err := s.cached(ctx, "branches/"+strconv.Itoa(projectID), func(ctx context.Context) (interface{}, error) {
+		return s.fetchBranches(ctx, projectID)
+	})
 	if err != nil {
-		log.Print(err)
 		return nil, err
 	}
-	return tags, err
+	return value.([]gitlabBranch), nil
+}
+
+func (s *server) fetchBranches(ctx context.Context, projectID int) ([]gitlabBranch, error) {
+	var mu sync.Mutex
+	pages := make(map[int][]gitlabBranch)
+	err := fetchPages(ctx, 100, s.config().gitlabPageWorkers, func(ctx context.Context, page int) (int, error) {
+		var listQueryOptions = &gitlab.ListBranchesOptions{
+			ListOptions: gitlab.ListOptions{
+				PerPage: 100, // this is the maximum one can ask for
+				Page:    page,
+			}}
+		withContext, done := s.gitlabRequest(ctx, "ListBranches")
+		branches, response, err := s.gl.Branches.ListBranches(projectID, listQueryOptions, withContext)
+		err = done(err)
+		if err != nil {
+			return 0, err
+		}
+		currentBranchList := make([]gitlabBranch, 0, len(branches))
+		for _, branch := range branches {
+			currentBranch := gitlabBranch{
+				Name:      branch.Name,
+				Default:   branch.Default,
+				Protected: branch.Protected,
+				Merged:    branch.Merged,
+			}
+			if branch.Commit != nil {
+				currentBranch.CommitID = branch.Commit.ID
+				currentBranch.ShortID = branch.Commit.ShortID
+				currentBranch.CommitTitle = branch.Commit.Title
+				currentBranch.CommitAuthor = branch.Commit.AuthorName
+				currentBranch.CommittedDate = branch.Commit.CommittedDate
+			}
+			currentBranchList = append(currentBranchList, currentBranch)
+		}
+		mu.Lock()
+		pages[page] = currentBranchList
+		mu.Unlock()
+		return response.TotalPages, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var branchList []gitlabBranch
+	for page := 1; page <= len(pages); page++ {
+		branchList = append(branchList, pages[page]...)
+	}
+	return branchList, nil
+}
+
+// gitlabComparison is the difference between two commits, branches or tags.
+type gitlabComparison struct {
+	Commits []gitlabCommitList
+	Diffs   []*gitlab.Diff
+	// GitLab gave up computing the diffs, they are incomplete
+	TimedOut bool
+}
+
+func (s *server) getComparison(ctx context.Context, projectID int, from string, to string) (gitlabComparison, error) {
+	value, err := s.cached(ctx, "compare/"+strconv.Itoa(projectID)+"?from="+from+"&to="+to, func(ctx context.Context) (interface{}, error) {
+		return s.fetchComparison(ctx, projectID, from, to)
+	})
+	if err != nil {
+		return gitlabComparison{}, err
+	}
+	return value.(gitlabComparison), nil
+}
 
+func (s *server) fetchComparison(ctx context.Context, projectID int, from string, to string) (gitlabComparison, error) {
+	compareOptions := &gitlab.CompareOptions{
+		From: gitlab.String(from),
+		To:   gitlab.String(to),
+	}
+	withContext, done := s.gitlabRequest(ctx, "Compare")
+	compare, _, err := s.gl.Repositories.Compare(projectID, compareOptions, withContext)
+	err = done(err)
+	if err != nil {
+		return gitlabComparison{}, err
+	}
+	comparison := gitlabComparison{
+		Commits:  make([]gitlabCommitList, len(compare.Commits)),
+		Diffs:    compare.Diffs,
+		TimedOut: compare.CompareTimeout,
+	}
+	for i, commit := range compare.Commits {
+		comparison.Commits[i] = gitlabCommitList{
+			ID:          commit.ID,
+			ShortID:     commit.ShortID,
+			CreatedAt:   commit.CreatedAt,
+			Title:       commit.Title,
+			AuthorName:  commit.AuthorName,
+			AuthorEmail: commit.AuthorEmail,
+			Tags:        []string{},
+		}
+	}
+	return comparison, nil
+}
+
+// errFileTooLarge is returned when a file is larger than allowed.
+var errFileTooLarge = errors.New("file is too large")
+
+// limitedBuffer collects at most max bytes and fails with errFileTooLarge
+// beyond that.
+type limitedBuffer struct {
+	data []byte
+	max  int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if len(b.data)+len(p) > b.max {
+		return 0, errFileTooLarge
+	}
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+// getRawFile returns the content of a file at a commit, branch or tag. Files
+// can be large, so they are not cached, and reading stops with
+// errFileTooLarge after maxBytes.
+func (s *server) getRawFile(ctx context.Context, projectID int, filePath string, ref string, maxBytes int) ([]byte, error) {
+	// the GitLab client would read the whole file into memory
+	u := fmt.Sprintf("projects/%d/repository/files/%s/raw", projectID, url.PathEscape(filePath))
+	withContext, done := s.gitlabRequest(ctx, "GetRawFile")
+	req, err := s.gl.NewRequest(http.MethodGet, u, &gitlab.GetRawFileOptions{Ref: gitlab.String(ref)}, []gitlab.RequestOptionFunc{withContext})
+	if err != nil {
+		return nil, done(err)
+	}
+	content := &limitedBuffer{max: maxBytes}
+	_, err = s.gl.Do(req, content)
+	if errors.Is(err, errFileTooLarge) {
+		// GitLab answered, the file is just too large
+		done(nil)
+		return nil, errFileTooLarge
+	}
+	err = done(err)
+	if err != nil {
+		return nil, err
+	}
+	return content.data, nil
+}
+
+// gitlabTag describes a tag. GitLab does not report when a tag was created,
+// Date is the date of the tagged commit.
+type gitlabTag struct {
+	Name     string     `json:"name"`
+	Message  string     `json:"message"`
+	Date     *time.Time `json:"date"`
+	CommitID string     `json:"commit_id"`
+}
+
+func (s *server) getTags(ctx context.Context, projectID int) ([]gitlabTag, error) {
+	value, err := s.cached(ctx, "tags/"+strconv.Itoa(projectID), func(ctx context.Context) (interface{}, error) {
+		return s.fetchTags(ctx, projectID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]gitlabTag), nil
+}
+
+func (s *server) fetchTags(ctx context.Context, projectID int) ([]gitlabTag, error) {
+	var mu sync.Mutex
+	pages := make(map[int][]gitlabTag)
+	err := fetchPages(ctx, 100, s.config().gitlabPageWorkers, func(ctx context.Context, page int) (int, error) {
+		var listQueryOptions = &gitlab.ListTagsOptions{
+			ListOptions: gitlab.ListOptions{
+				PerPage: 100, // this is the maximum one can ask for
+				Page:    page,
+			}}
+		withContext, done := s.gitlabRequest(ctx, "ListTags")
+		tags, response, err := s.gl.Tags.ListTags(projectID, listQueryOptions, withContext)
+		err = done(err)
+		if err != nil {
+			return 0, err
+		}
+		currentTagList := make([]gitlabTag, 0, len(tags))
+		for _, tag := range tags {
+			if tag.Commit == nil {
+				continue
+			}
+			currentTagList = append(currentTagList, gitlabTag{
+				Name:     tag.Name,
+				Message:  tag.Message,
+				Date:     tag.Commit.CommittedDate,
+				CommitID: tag.Commit.ID,
+			})
+		}
+		mu.Lock()
+		pages[page] = currentTagList
+		mu.Unlock()
+		return response.TotalPages, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var tagList []gitlabTag
+	for page := 1; page <= len(pages); page++ {
+		tagList = append(tagList, pages[page]...)
+	}
+	return tagList, nil
+}
+
+// tagMatches reports whether the tag name matches one of the shell-style
+// patterns, e.g. CADI-BuildTag*.
+func tagMatches(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTags attaches the tags matching the patterns to the commits they
+// point to.
+func matchTags(commits []gitlabCommitList, tags []gitlabTag, patterns []string) {
+	tagsByCommit := make(map[string][]gitlabTag)
+	for _, tag := range tags {
+		if tagMatches(tag.Name, patterns) {
+			tagsByCommit[tag.CommitID] = append(tagsByCommit[tag.CommitID], tag)
+		}
+	}
+	for n, commit := range commits {
+		commitTags := tagsByCommit[commit.ID]
+		if len(commitTags) == 0 {
+			continue
+		}
+		commits[n].Tags = make([]string, len(commitTags))
+		for i, tag := range commitTags {
+			commits[n].Tags[i] = tag.Name
+		}
+		commits[n].TagDetails = commitTags
+		commits[n].Tag = commitTags[0].Name
+	}
+}
+
+// get the diff job of a pipeline in the pipeline project
+func (s *server) getPipelineJob(ctx context.Context, pipelineID int) (*gitlab.Job, error) {
+	pipelineProjectID := getPipelineProjectID()
+	withContext, done := s.gitlabRequest(ctx, "ListPipelineJobs")
+	pipelineJobs, _, err := s.gl.Jobs.ListPipelineJobs(pipelineProjectID, pipelineID, nil, withContext)
+	err = done(err)
+	if err != nil {
+		return nil, err
+	}
+	if len(pipelineJobs) == 0 {
+		return nil, errors.New("pipeline has no jobs")
+	}
+	withContext, done = s.gitlabRequest(ctx, "GetJob")
+	job, _, err := s.gl.Jobs.GetJob(pipelineProjectID, pipelineJobs[0].ID, withContext)
+	return job, done(err)
+}
+
+// trigger a pipeline diffing two commits of a project
+func (s *server) runDiffPipeline(ctx context.Context, trigger triggerStruct) (*gitlab.Pipeline, error) {
+	var variables = make(map[string]string)
+	variables["REPO_PROJECT"] = trigger.Project
+	variables["REPO_GROUP"] = trigger.Group
+	variables["GIT_SHA1"] = trigger.SHA1
+	variables["GIT_SHA2"] = trigger.SHA2
+
+	referenceBranch := "master"
+	pipelineOptions := &gitlab.RunPipelineTriggerOptions{
+		Ref:       &referenceBranch,
+		Token:     &s.config().triggerToken,
+		Variables: variables,
+	}
+
+	withContext, done := s.gitlabRequest(ctx, "RunPipelineTrigger")
+	pipeline, _, err := s.gl.PipelineTriggers.RunPipelineTrigger(getPipelineProjectID(), pipelineOptions, withContext)
+	err = done(err)
+	if err != nil {
+		return nil, err
+	}
+	pipelinesTriggeredTotal.WithLabelValues(trigger.Group).Inc()
+	return pipeline, nil
+}
+
+// get the variables a pipeline has been triggered with
+func (s *server) getPipelineVariables(ctx context.Context, pipelineID int) (map[string]string, error) {
+	withContext, done := s.gitlabRequest(ctx, "GetPipelineVariables")
+	pipelineVariables, _, err := s.gl.Pipelines.GetPipelineVariables(getPipelineProjectID(), pipelineID, withContext)
+	err = done(err)
+	if err != nil {
+		return nil, err
+	}
+	variables := make(map[string]string, len(pipelineVariables))
+	for _, variable := range pipelineVariables {
+		variables[variable.Key] = variable.Value
+	}
+	return variables, nil
 }
 
 // check that provided subgroups exist in project
-func validateSubgroups(groupID int, gl *gitlab.Client, configuration Configuration) (map[string]int, error) {
-	groups, _, err := gl.Groups.ListSubgroups(groupID, nil)
+func validateSubgroups(ctx context.Context, groupID int, gl *gitlab.Client, configuration Configuration) (map[string]int, error) {
+	withContext, done := gitlabRequest(ctx, &configuration, "ListSubgroups")
+	groups, _, err := gl.Groups.ListSubgroups(groupID, nil, withContext)
+	err = done(err)
 	if err != nil {
-		log.Print(err)
+		contextLogger(ctx).WithError(err).Error("Listing subgroups failed")
 	}
 
 	groupIDMap := make(map[string]int)
@@ -106,20 +524,23 @@ func validateSubgroups(groupID int, gl *gitlab.Client, configuration Configurati
 }
 
 // get all projects for a given subgroup
-func getProjects(groupID int, gl *gitlab.Client) ([]gitlabProjectList, error) {
-	maxPages := 100
-	currentPage := 1
-	var projectList []gitlabProjectList
-	for currentPage <= maxPages {
+func (s *server) getProjects(ctx context.Context, groupID int) ([]gitlabProjectList, error) {
+	var mu sync.Mutex
+	pages := make(map[int][]gitlabProjectList)
+	err := fetchPages(ctx, 100, s.config().gitlabPageWorkers, func(ctx context.Context, page int) (int, error) {
+		if !s.waitForRateLimit() {
+			return 0, errors.New("shutting down")
+		}
 		var listQueryOptions = &gitlab.ListGroupProjectsOptions{
 			ListOptions: gitlab.ListOptions{
 				PerPage: 100, // this is the maximum one can ask for
-				Page:    currentPage,
+				Page:    page,
 			}}
-		projects, response, err := gl.Groups.ListGroupProjects(groupID, listQueryOptions)
+		withContext, done := s.gitlabRequest(ctx, "ListGroupProjects")
+		projects, response, err := s.gl.Groups.ListGroupProjects(groupID, listQueryOptions, withContext)
+		err = done(err)
 		if err != nil {
-			log.Print(err)
-			return projectList, err
+			return 0, err
 		}
 		currentProjectList := make([]gitlabProjectList, len(projects))
 		for i := 0; i < len(projects); i++ {
@@ -130,24 +551,47 @@ func getProjects(groupID int, gl *gitlab.Client) ([]gitlabProjectList, error) {
 				LastActivityAt: projects[i].LastActivityAt,
 				Description:    projects[i].Description,
 			}
-			projectList = append(projectList, currentProjectList[i])
 		}
-		maxPages = response.TotalPages
-		currentPage++
+		mu.Lock()
+		pages[page] = currentProjectList
+		mu.Unlock()
+		return response.TotalPages, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var projectList []gitlabProjectList
+	for page := 1; page <= len(pages); page++ {
+		projectList = append(projectList, pages[page]...)
 	}
-	log.Println("Number of projects:", len(projectList))
+	contextLogger(ctx).WithField("group_id", groupID).Debugf("Number of projects: %d", len(projectList))
 	return projectList, nil
 }
 
-func updateProjects(groupIDs map[string]int, gl *gitlab.Client) (map[string][]gitlabProjectList, error) {
+// get the projects of all groups in parallel, groups that failed are
+// reported in the error map and missing from the project map
+func (s *server) updateProjects(ctx context.Context, groupIDs map[string]int) (map[string][]gitlabProjectList, map[string]error) {
 	allProjects := make(map[string][]gitlabProjectList)
-	var err error
+	groupErrors := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
 	for value, key := range groupIDs {
-		log.Println("Getting projects for group:", value, key)
-		allProjects[value], err = getProjects(key, gl)
-		if err != nil {
-			log.Print(err)
-		}
+		wg.Add(1)
+		go func(value string, key int) {
+			defer wg.Done()
+			groupLogger := logger.WithFields(logrus.Fields{"group": value, "group_id": key})
+			groupLogger.Debug("Getting projects for group")
+			projects, err := s.getProjects(ctx, key)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				groupLogger.WithError(err).Error("Getting projects for group failed")
+				groupErrors[value] = err
+				return
+			}
+			allProjects[value] = projects
+		}(value, key)
 	}
-	return allProjects, err
+	wg.Wait()
+	return allProjects, groupErrors
 }
@@ -2,24 +2,25 @@ package main
 
 import (
 	"errors"
-	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
 	"github.com/xanzy/go-gitlab"
 )
 
 type gitlabCommitList struct {
-	ID          string     `json:"id"`
-	ShortID     string     `json:"short_id"`
-	CreatedAt   *time.Time `json:"created_at"`
-	Title       string     `json:"title"`
-	AuthorName  string     `json:"author_name"`
-	AuthorEmail string     `json:"author_email"`
-	Tag         string     `json:"tag"`
+	ID          string      `json:"id"`
+	ShortID     string      `json:"short_id"`
+	CreatedAt   *time.Time  `json:"created_at"`
+	Title       string      `json:"title"`
+	AuthorName  string      `json:"author_name"`
+	AuthorEmail string      `json:"author_email"`
+	Tag         string      `json:"tag"` // first of Tags, kept for older clients
+	Tags        []string    `json:"tags"`
+	TagDetails  []gitlabTag `json:"tag_details,omitempty"`
 }
 
 type triggerStruct struct {
@@ -31,13 +32,17 @@ type triggerStruct struct {
 
 func (s *server) handleTypes() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		respond(w, r, http.StatusOK, projTypes)
+		stateMu.RLock()
+		types := projTypes
+		stateMu.RUnlock()
+		respond(w, r, http.StatusOK, types)
 	}
 }
 
 func (s *server) handleProjects() http.HandlerFunc {
 	type response struct {
-		Data []gitlabProjectList `json:"data"`
+		Data  []gitlabProjectList `json:"data"`
+		Stale bool                `json:"stale"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -46,27 +51,59 @@ func (s *server) handleProjects() http.HandlerFunc {
 			respondErr(w, r, http.StatusBadRequest, ok)
 			return
 		}
-		log.Println(groupID)
-		for key := range groupIDs {
-			if key == groupID {
-				projectResponse := response{
-					Data: allProjects[groupID],
-				}
-				respond(w, r, http.StatusOK, projectResponse)
-				return
-			}
+		requestLogger(r).WithField("group", groupID).Debug("Listing projects")
+		// copy under the lock, writing the response may take a while
+		stateMu.RLock()
+		_, known := groupIDs[groupID]
+		projects := append([]gitlabProjectList(nil), allProjects[groupID]...)
+		var status *groupRefreshStatus
+		if currentStatus, ok := groupStatus[groupID]; ok {
+			statusCopy := *currentStatus
+			status = &statusCopy
+		}
+		stateMu.RUnlock()
+		if !known {
+			errorMessage := "Project not found: " + groupID
+			err := errors.New(errorMessage)
+			respondErr(w, r, http.StatusBadRequest, err)
+			return
+		}
+		projectResponse := response{
+			Data: projects,
 		}
-		errorMessage := "Project not found: " + groupID
-		err := errors.New(errorMessage)
-		respondErr(w, r, http.StatusBadRequest, err)
-		return
+		// the projects are always served from the cache, they are stale if
+		// the last refresh of the group failed
+		if status != nil && status.LastSuccess != nil {
+			projectResponse.Stale = status.LastError != ""
+			setDataAge(w, *status.LastSuccess)
+		}
+		respond(w, r, http.StatusOK, projectResponse)
 	}
 }
 
 func (s *server) handleCommits() http.HandlerFunc {
 	type response struct {
 		ProjectInfo gitlabProjectList  `json:"project_info"`
+		Ref         string             `json:"ref,omitempty"`
 		CommitList  []gitlabCommitList `json:"commits"`
+		Stale       bool               `json:"stale"`
+	}
+	// serveStale responds with the last known commits if GitLab is
+	// unavailable
+	serveStale := func(w http.ResponseWriter, r *http.Request, key string, err error) bool {
+		if !isGitLabOutage(err) {
+			return false
+		}
+		cached, storedAt, ok := s.lastKnown.load(key)
+		if !ok {
+			return false
+		}
+		requestLogger(r).WithError(err).Warn("GitLab unavailable, serving cached commits")
+		commitResponse := cached.(response)
+		commitResponse.Stale = true
+		setDataAge(w, storedAt)
+		respond(w, r, http.StatusOK, commitResponse)
+		return true
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -80,36 +117,42 @@ func (s *server) handleCommits() http.HandlerFunc {
 			respondErr(w, r, http.StatusBadRequest, ok)
 			return
 		}
-		log.Println(projectGroup, projectID)
-		projectInfo, _, err := s.getProjectInfo(projectGroup, projectID)
+		// commits of the default branch unless a branch, tag or commit is given
+		ref := r.URL.Query().Get("ref")
+		requestLogger(r).WithFields(logrus.Fields{"group": projectGroup, "project": projectID, "ref": ref}).Debug("Listing commits")
+		cacheKey := "commits/" + projectGroup + "/" + projectID + "?ref=" + ref
+		projectInfo, err := s.getProjectInfo(r.Context(), projectGroup, projectID)
 		if err != nil {
-			respondErr(w, r, http.StatusBadRequest, err)
+			if serveStale(w, r, cacheKey, err) {
+				return
+			}
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
 			return
 		}
-		commitList, err := s.getCommits(projectInfo.ID)
+		commitList, err := s.getCommits(r.Context(), projectInfo.ID, ref)
 		if err != nil {
-			respondErr(w, r, http.StatusBadRequest, err)
+			if serveStale(w, r, cacheKey, err) {
+				return
+			}
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
 			return
 		}
-		tagList, err := s.getTags(projectInfo.ID)
+		requestLogger(r).Debugf("Number of commits: %d", len(commitList))
+		tagList, err := s.getTags(r.Context(), projectInfo.ID)
 		if err != nil {
-			respondErr(w, r, http.StatusBadRequest, err)
-			return
-		}
-		// match tags to commits
-		for n, commit := range commitList {
-			for _, tag := range tagList {
-				if strings.HasPrefix(tag.Name, "CADI-BuildTag") {
-					if commit.ShortID == tag.Commit.ShortID {
-						commitList[n].Tag = tag.Name
-					}
-				}
+			if serveStale(w, r, cacheKey, err) {
+				return
 			}
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
 		}
+		matchTags(commitList, tagList, s.config().tagPatterns)
 		commitResponse := response{
 			ProjectInfo: projectInfo,
+			Ref:         ref,
 			CommitList:  commitList,
 		}
+		s.lastKnown.store(cacheKey, commitResponse)
 		respond(w, r, http.StatusOK, commitResponse)
 	}
 }
@@ -125,21 +168,15 @@ func (s *server) handlePipelineStatus() http.HandlerFunc {
 			respondErr(w, r, http.StatusBadRequest, ok)
 			return
 		}
-		log.Println(pipelineIDString)
+		requestLogger(r).WithField("pipeline_id", pipelineIDString).Debug("Getting pipeline status")
 		pipelineID, err := strconv.Atoi(pipelineIDString)
 		if err != nil {
 			respondErr(w, r, http.StatusBadRequest, err)
 			return
 		}
-		pipelineJobs, _, err := s.gl.Jobs.ListPipelineJobs(pipelineProjectID, pipelineID, nil)
+		job, err := s.getPipelineJob(r.Context(), pipelineID)
 		if err != nil {
-			respondErr(w, r, http.StatusBadRequest, err)
-			return
-		}
-		jobID := pipelineJobs[0].ID
-		job, _, err := s.gl.Jobs.GetJob(pipelineProjectID, jobID, nil)
-		if err != nil {
-			respondErr(w, r, http.StatusBadRequest, err)
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
 			return
 		}
 		pipelineStatusResponse := response{
@@ -157,27 +194,42 @@ func (s *server) handleTrigger() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var triggerObject triggerStruct
 		if err := decodeBody(r, &triggerObject); err != nil {
+			s.audit(r, "trigger", nil, err)
 			respondErr(w, r, http.StatusBadRequest, err)
 			return
 		}
-		var variables = make(map[string]string)
-		variables["REPO_PROJECT"] = triggerObject.Project
-		variables["REPO_GROUP"] = triggerObject.Group
-		variables["GIT_SHA1"] = triggerObject.SHA1
-		variables["GIT_SHA2"] = triggerObject.SHA2
-
-		referenceBranch := "master"
-		pipelineOptions := &gitlab.RunPipelineTriggerOptions{
-			Ref:       &referenceBranch,
-			Token:     &s.configuration.triggerToken,
-			Variables: variables,
+		auditParams := map[string]string{
+			"group":   triggerObject.Group,
+			"project": triggerObject.Project,
+			"sha1":    triggerObject.SHA1,
+			"sha2":    triggerObject.SHA2,
 		}
-
-		pipeline, _, err := s.gl.PipelineTriggers.RunPipelineTrigger(pipelineProjectID, pipelineOptions)
-		if err != nil {
+		if triggerObject.Group == "" || triggerObject.Project == "" || triggerObject.SHA1 == "" || triggerObject.SHA2 == "" {
+			err := errors.New("group, project, sha1 and sha2 are required")
+			s.audit(r, "trigger", auditParams, err)
 			respondErr(w, r, http.StatusBadRequest, err)
 			return
 		}
+		pipeline, err := s.runDiffPipeline(r.Context(), triggerObject)
+		if err != nil {
+			s.audit(r, "trigger", auditParams, err)
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		auditParams["pipeline_id"] = strconv.Itoa(pipeline.ID)
+		s.audit(r, "trigger", auditParams, nil)
+		identity, _ := Identity(r.Context())
+		if err := s.history.add(historyEntry{
+			PipelineID:  pipeline.ID,
+			Group:       triggerObject.Group,
+			Project:     triggerObject.Project,
+			SHA1:        triggerObject.SHA1,
+			SHA2:        triggerObject.SHA2,
+			TriggeredAt: time.Now().UTC(),
+			TriggeredBy: identity,
+		}); err != nil {
+			requestLogger(r).WithError(err).Error("Recording diff in history failed")
+		}
 		triggerReponse := response{
 			Status:     "Pipeline triggered successfully!",
 			PipelineID: pipeline.ID,
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// historyEntry records a triggered diff pipeline.
+type historyEntry struct {
+	PipelineID  int       `json:"pipeline_id"`
+	Group       string    `json:"group"`
+	Project     string    `json:"project"`
+	SHA1        string    `json:"sha1"`
+	SHA2        string    `json:"sha2"`
+	TriggeredAt time.Time `json:"triggered_at"`
+	TriggeredBy string    `json:"triggered_by"`
+}
+
+type historyKey struct {
+	group, project, sha1, sha2 string
+}
+
+// historyStore is an append-only JSON lines file of triggered diffs, like
+// the audit log. The latest diff of every pair of commits is kept in memory.
+// The file is local to the process, so replicas do not know about the diffs
+// triggered by each other.
+type historyStore struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	latest map[historyKey]historyEntry
+}
+
+func newHistoryStore(path string) (*historyStore, error) {
+	h := &historyStore{
+		path:   path,
+		latest: make(map[historyKey]historyEntry),
+	}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	h.file = file
+	return h, nil
+}
+
+// load reads the existing entries. Lines that cannot be parsed, e.g. a
+// half written last line, are skipped.
+func (h *historyStore) load() error {
+	file, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		h.index(entry)
+	}
+	return scanner.Err()
+}
+
+// index remembers the entry as the latest diff of its commits. Must be
+// called with h.mu held or before the store is shared.
+func (h *historyStore) index(entry historyEntry) {
+	h.latest[historyKey{entry.Group, entry.Project, entry.SHA1, entry.SHA2}] = entry
+}
+
+func (h *historyStore) add(entry historyEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.index(entry)
+	_, err = h.file.Write(line)
+	return err
+}
+
+// find returns the latest diff of the two commits of a project.
+func (h *historyStore) find(group, project, sha1, sha2 string) (historyEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry, ok := h.latest[historyKey{group, project, sha1, sha2}]
+	return entry, ok
+}
+
+// check reports whether the history file is still in place.
+func (h *historyStore) check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := os.Stat(h.path)
+	return err
+}
+
+// close flushes and closes the history file.
+func (h *historyStore) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.file.Sync(); err != nil {
+		h.file.Close()
+		return err
+	}
+	return h.file.Close()
+}
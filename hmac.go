@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers used by machine clients to sign requests instead of sending the
+// static API token.
+const (
+	headerClientID  = "X-Client-ID"
+	headerTimestamp = "X-Timestamp"
+	headerNonce     = "X-Nonce"
+	headerSignature = "X-Signature"
+)
+
+// maxRequestBodyBytes limits the bodies of protected requests, which are
+// read before authentication to check their signature. /trigger and /share
+// only take small JSON objects.
+const maxRequestBodyBytes = 64 << 10
+
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+var contextKeyIdentity = &contextKey{"identity"}
+
+// withBodyLimit limits the size of the request body to maxBytes.
+func withBodyLimit(fn http.HandlerFunc, maxBytes int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+		fn(w, r)
+	}
+}
+
+// Identity returns the authenticated identity of the caller
+func Identity(ctx context.Context) (string, bool) {
+	identity := ctx.Value(contextKeyIdentity)
+	if identity == nil {
+		return "", false
+	}
+	identitystr, ok := identity.(string)
+	return identitystr, ok
+}
+
+// nonceCache remembers nonces for as long as their timestamp is accepted so
+// that a captured request cannot be replayed. Nonces are kept in the order
+// they were seen, so expiring them only looks at the oldest ones.
+type nonceCache struct {
+	mu     sync.Mutex
+	seen   map[string]bool
+	order  *list.List // of seenNonce, oldest first
+	window time.Duration
+}
+
+type seenNonce struct {
+	nonce  string
+	seenAt time.Time
+}
+
+func newNonceCache(window time.Duration) *nonceCache {
+	return &nonceCache{
+		seen:   make(map[string]bool),
+		order:  list.New(),
+		window: window,
+	}
+}
+
+// add records the nonce and reports whether it had not been seen before.
+func (c *nonceCache) add(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for oldest := c.order.Front(); oldest != nil; oldest = c.order.Front() {
+		entry := oldest.Value.(seenNonce)
+		if now.Sub(entry.seenAt) <= 2*c.window {
+			break
+		}
+		delete(c.seen, entry.nonce)
+		c.order.Remove(oldest)
+	}
+	if c.seen[nonce] {
+		return false
+	}
+	c.seen[nonce] = true
+	c.order.PushBack(seenNonce{nonce: nonce, seenAt: now})
+	return true
+}
+
+type requestSigner struct {
+	secret  []byte
+	maxSkew time.Duration
+	nonces  *nonceCache
+}
+
+func newRequestSigner(secret string, maxSkew time.Duration) *requestSigner {
+	if secret == "" {
+		return nil
+	}
+	return &requestSigner{
+		secret:  []byte(secret),
+		maxSkew: maxSkew,
+		nonces:  newNonceCache(maxSkew),
+	}
+}
+
+// canonicalRequest builds the string that is signed by the client:
+// method, request URI, timestamp, nonce, client ID and the hex encoded
+// SHA-256 of the body, separated by newlines.
+func canonicalRequest(r *http.Request, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		r.Method,
+		r.URL.RequestURI(),
+		r.Header.Get(headerTimestamp),
+		r.Header.Get(headerNonce),
+		r.Header.Get(headerClientID),
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+func (rs *requestSigner) sign(r *http.Request, body []byte) []byte {
+	mac := hmac.New(sha256.New, rs.secret)
+	mac.Write([]byte(canonicalRequest(r, body)))
+	return mac.Sum(nil)
+}
+
+// verify checks the signature headers of the request and returns the client
+// ID. The request body is restored so that handlers can still decode it.
+func (rs *requestSigner) verify(r *http.Request) (string, error) {
+	clientID := r.Header.Get(headerClientID)
+	if clientID == "" {
+		return "", errors.New("missing " + headerClientID + " header")
+	}
+	nonce := r.Header.Get(headerNonce)
+	if nonce == "" {
+		return "", errors.New("missing " + headerNonce + " header")
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(headerTimestamp), 10, 64)
+	if err != nil {
+		return "", errors.New("invalid " + headerTimestamp + " header")
+	}
+	now := time.Now()
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > rs.maxSkew || skew < -rs.maxSkew {
+		return "", errors.New("request timestamp outside of accepted window")
+	}
+	signature, err := hex.DecodeString(r.Header.Get(headerSignature))
+	if err != nil {
+		return "", errors.New("invalid " + headerSignature + " header")
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			// withBodyLimit stops reading at the limit
+			if len(body) >= maxRequestBodyBytes {
+				return "", errRequestBodyTooLarge
+			}
+			return "", err
+		}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if !hmac.Equal(signature, rs.sign(r, body)) {
+		return "", errors.New("invalid request signature")
+	}
+	// only remember nonces of correctly signed requests, otherwise anyone
+	// could fill the cache
+	if !rs.nonces.add(clientID+":"+nonce, now) {
+		return "", errors.New("nonce already used")
+	}
+	return clientID, nil
+}
+
+// withSignature authenticates requests carrying an HMAC signature. Requests
+// without a signature are passed on unchanged so that withAPIKey can check
+// the static token instead.
+func withSignature(fn http.HandlerFunc, signer *requestSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if signer == nil || r.Header.Get(headerSignature) == "" {
+			fn(w, r)
+			return
+		}
+		clientID, err := signer.verify(r)
+		if err == errRequestBodyTooLarge {
+			respondErr(w, r, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if err != nil {
+			respondErr(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		ctx := context.WithValue(r.Context(), contextKeyIdentity, "hmac:"+clientID)
+		setRequestIdentity(ctx, "hmac:"+clientID)
+		fn(w, r.WithContext(ctx))
+	}
+}
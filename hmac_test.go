@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest returns a request to uri signed by signer at the given time.
+func signedRequest(signer *requestSigner, uri string, body string, at time.Time, nonce string) *http.Request {
+	r := httptest.NewRequest("POST", uri, strings.NewReader(body))
+	r.Header.Set(headerClientID, "ci")
+	r.Header.Set(headerTimestamp, strconv.FormatInt(at.Unix(), 10))
+	r.Header.Set(headerNonce, nonce)
+	r.Header.Set(headerSignature, hex.EncodeToString(signer.sign(r, []byte(body))))
+	return r
+}
+
+func TestWithSignature(t *testing.T) {
+	const body = `{"group":"CMS"}`
+	maxSkew := time.Minute
+	tests := []struct {
+		name    string
+		request func(signer *requestSigner) *http.Request
+		replay  bool
+		status  int
+	}{
+		{
+			name: "valid signature",
+			request: func(signer *requestSigner) *http.Request {
+				return signedRequest(signer, "/trigger", body, time.Now(), "n1")
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "tampered body",
+			request: func(signer *requestSigner) *http.Request {
+				r := signedRequest(signer, "/trigger", body, time.Now(), "n1")
+				r.Body = ioutil.NopCloser(strings.NewReader(`{"group":"EXO"}`))
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "tampered path",
+			request: func(signer *requestSigner) *http.Request {
+				r := signedRequest(signer, "/trigger", body, time.Now(), "n1")
+				r.URL.Path = "/share"
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "tampered query",
+			request: func(signer *requestSigner) *http.Request {
+				r := signedRequest(signer, "/admin/audit?limit=1", "", time.Now(), "n1")
+				r.URL.RawQuery = "limit=1000"
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "tampered timestamp",
+			request: func(signer *requestSigner) *http.Request {
+				now := time.Now()
+				r := signedRequest(signer, "/trigger", body, now, "n1")
+				r.Header.Set(headerTimestamp, strconv.FormatInt(now.Unix()-10, 10))
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "tampered client ID",
+			request: func(signer *requestSigner) *http.Request {
+				r := signedRequest(signer, "/trigger", body, time.Now(), "n1")
+				r.Header.Set(headerClientID, "admin")
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "replayed nonce",
+			request: func(signer *requestSigner) *http.Request {
+				return signedRequest(signer, "/trigger", body, time.Now(), "n1")
+			},
+			replay: true,
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "timestamp too old",
+			request: func(signer *requestSigner) *http.Request {
+				return signedRequest(signer, "/trigger", body, time.Now().Add(-2*maxSkew), "n1")
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "timestamp in the future",
+			request: func(signer *requestSigner) *http.Request {
+				return signedRequest(signer, "/trigger", body, time.Now().Add(2*maxSkew), "n1")
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "invalid signature encoding",
+			request: func(signer *requestSigner) *http.Request {
+				r := signedRequest(signer, "/trigger", body, time.Now(), "n1")
+				r.Header.Set(headerSignature, "not hex")
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "missing nonce",
+			request: func(signer *requestSigner) *http.Request {
+				return signedRequest(signer, "/trigger", body, time.Now(), "")
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "oversized body",
+			request: func(signer *requestSigner) *http.Request {
+				return signedRequest(signer, "/trigger", strings.Repeat("x", maxRequestBodyBytes+1), time.Now(), "n1")
+			},
+			status: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signer := newRequestSigner("secret", maxSkew)
+			var gotBody string
+			var gotIdentity string
+			handler := withBodyLimit(withSignature(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := ioutil.ReadAll(r.Body)
+				gotBody = string(data)
+				gotIdentity, _ = Identity(r.Context())
+			}, signer), maxRequestBodyBytes)
+
+			if test.replay {
+				w := httptest.NewRecorder()
+				handler(w, test.request(signer))
+				if w.Code != http.StatusOK {
+					t.Fatalf("got status %d for the first request, want %d", w.Code, http.StatusOK)
+				}
+			}
+			w := httptest.NewRecorder()
+			handler(w, test.request(signer))
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			if test.status == http.StatusOK {
+				if gotBody != body {
+					t.Errorf("handler got body %q, want %q", gotBody, body)
+				}
+				if gotIdentity != "hmac:ci" {
+					t.Errorf("got identity %q, want hmac:ci", gotIdentity)
+				}
+			}
+		})
+	}
+}
+
+func TestWithSignatureWithoutSignature(t *testing.T) {
+	called := false
+	handler := withSignature(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if _, ok := Identity(r.Context()); ok {
+			t.Error("unsigned request has an identity")
+		}
+	}, newRequestSigner("secret", time.Minute))
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/types", nil))
+	if !called {
+		t.Error("unsigned request was not passed on to the API key check")
+	}
+}
+
+func TestNonceCacheExpiry(t *testing.T) {
+	c := newNonceCache(time.Minute)
+	now := time.Now()
+	if !c.add("a", now) {
+		t.Fatal("new nonce rejected")
+	}
+	if c.add("a", now.Add(time.Minute)) {
+		t.Error("nonce accepted again within the window")
+	}
+	if !c.add("a", now.Add(3*time.Minute)) {
+		t.Error("nonce still rejected after the window")
+	}
+	if len(c.seen) != 1 || c.order.Len() != 1 {
+		t.Errorf("got %d nonces and %d in order, want 1", len(c.seen), c.order.Len())
+	}
+}
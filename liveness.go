@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -20,12 +22,19 @@ func (s *server) handlePing() http.HandlerFunc {
 
 func (s *server) handleLastUpdated() http.HandlerFunc {
 	type response struct {
-		LastUpdated time.Time `json:"lastUpdated"`
+		LastUpdated time.Time                     `json:"lastUpdated"`
+		Groups      map[string]groupRefreshStatus `json:"groups"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
+		stateMu.RLock()
 		lastUpdatedResponse := response{
 			LastUpdated: lastUpdated,
+			Groups:      make(map[string]groupRefreshStatus, len(groupStatus)),
 		}
+		for group, status := range groupStatus {
+			lastUpdatedResponse.Groups[group] = *status
+		}
+		stateMu.RUnlock()
 		respond(w, r, http.StatusOK, lastUpdatedResponse)
 	}
 }
@@ -41,7 +50,7 @@ func (s *server) handleVersion() http.HandlerFunc {
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		headers := []string{}
-		if s.configuration.debug {
+		if s.config().debug {
 			for k, v := range r.Header {
 				if len(v) == 0 {
 					headers = append(headers, k)
@@ -71,3 +80,156 @@ func (s *server) handleVersion() http.HandlerFunc {
 	}
 
 }
+
+type healthCheck struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// gitlabProbe keeps the result of the GitLab reachability check, which is
+// run in the background so that readiness probes neither wait for nor
+// hammer GitLab.
+type gitlabProbe struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	result    healthCheck
+}
+
+const gitlabProbeInterval = 30 * time.Second
+
+// runGitLabProbe checks every gitlabProbeInterval whether GitLab can be
+// reached. It returns once the server is shutting down.
+func (s *server) runGitLabProbe() {
+	for {
+		s.probeGitLab()
+		timer := time.NewTimer(gitlabProbeInterval)
+		select {
+		case <-s.stopping:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *server) probeGitLab() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	withContext, done := s.gitlabRequest(ctx, "CurrentUser")
+	_, _, err := s.gl.Users.CurrentUser(withContext)
+	err = done(err)
+	result := healthCheck{OK: true}
+	if err != nil {
+		result = healthCheck{OK: false, Message: err.Error()}
+	}
+	s.gitlabProbe.mu.Lock()
+	defer s.gitlabProbe.mu.Unlock()
+	s.gitlabProbe.result = result
+	s.gitlabProbe.checkedAt = time.Now()
+}
+
+// gitlabReachable returns the result of the last GitLab check.
+func (s *server) gitlabReachable() healthCheck {
+	s.gitlabProbe.mu.Lock()
+	defer s.gitlabProbe.mu.Unlock()
+	if s.gitlabProbe.checkedAt.IsZero() {
+		return healthCheck{OK: false, Message: "not checked yet"}
+	}
+	return s.gitlabProbe.result
+}
+
+// readinessChecks returns the checks that decide readiness and the checks
+// that are only informational. Readiness only depends on local state: if
+// GitLab fails, every replica would be taken out of the service at once,
+// while they could still serve the cached data.
+func (s *server) readinessChecks() (map[string]healthCheck, map[string]healthCheck) {
+	checks := make(map[string]healthCheck)
+	info := make(map[string]healthCheck)
+	if s.shuttingDown() {
+		checks["shutdown"] = healthCheck{OK: false, Message: "shutting down"}
+	}
+	info["gitlab"] = s.gitlabReachable()
+	info["gitlab_rate_limit"] = s.rateLimit.check()
+
+	stateMu.RLock()
+	resolvedPipelineProjectID := pipelineProjectID
+	currentGroupsResolved := groupsResolved
+	loaded := projectsLoaded
+	age := time.Since(lastUpdated)
+	stateMu.RUnlock()
+	if resolvedPipelineProjectID == 0 {
+		info["pipeline_project"] = healthCheck{OK: false, Message: "pipeline project not resolved"}
+	} else {
+		info["pipeline_project"] = healthCheck{OK: true}
+	}
+	if !currentGroupsResolved {
+		info["groups"] = healthCheck{OK: false, Message: "not all groups resolved"}
+	} else {
+		info["groups"] = healthCheck{OK: true}
+	}
+
+	// old projects are still served, an outdated cache is not a reason to
+	// stop serving
+	if !loaded {
+		checks["project_cache"] = healthCheck{OK: false, Message: "projects not loaded yet"}
+	} else {
+		checks["project_cache"] = healthCheck{OK: true}
+		maxAge := 3 * time.Duration(s.config().updateIntervalSeconds) * time.Second
+		if age > maxAge {
+			info["project_cache_age"] = healthCheck{OK: false, Message: fmt.Sprintf("projects last updated %s ago, more than %s", age.Round(time.Second), maxAge)}
+		} else {
+			info["project_cache_age"] = healthCheck{OK: true, Message: fmt.Sprintf("projects last updated %s ago", age.Round(time.Second))}
+		}
+	}
+
+	if err := s.auditLog.check(); err != nil {
+		checks["audit_log"] = healthCheck{OK: false, Message: err.Error()}
+	} else {
+		checks["audit_log"] = healthCheck{OK: true}
+	}
+
+	// without the history, diffs are only not recognised as triggered before
+	if err := s.history.check(); err != nil {
+		info["history"] = healthCheck{OK: false, Message: err.Error()}
+	} else {
+		info["history"] = healthCheck{OK: true}
+	}
+	return checks, info
+}
+
+// handleHealthz reports whether the process is alive, it does not check any
+// dependencies.
+func (s *server) handleHealthz() http.HandlerFunc {
+	type response struct {
+		Status string `json:"status"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		respond(w, r, http.StatusOK, response{Status: "ok"})
+	}
+}
+
+// handleReadyz reports whether the server can serve requests, with details
+// for every check. The informational checks do not affect the status.
+func (s *server) handleReadyz() http.HandlerFunc {
+	type response struct {
+		Status string                 `json:"status"`
+		Checks map[string]healthCheck `json:"checks"`
+		Info   map[string]healthCheck `json:"info"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks, info := s.readinessChecks()
+		readyResponse := response{
+			Status: "ok",
+			Checks: checks,
+			Info:   info,
+		}
+		status := http.StatusOK
+		for _, check := range checks {
+			if !check.OK {
+				readyResponse.Status = "fail"
+				status = http.StatusServiceUnavailable
+			}
+		}
+		respond(w, r, status, readyResponse)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	authBaseDelay = 250 * time.Millisecond
+	authMaxDelay  = 5 * time.Second
+	// forgotten failures are removed at most this often
+	authSweepInterval = time.Minute
+	// at most this many clients are tracked, the one with the oldest
+	// failure is forgotten beyond that
+	authMaxClients = 10000
+)
+
+type authFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// authLimiter counts failed authentication attempts per client IP. Clients
+// with recent failures are slowed down progressively and locked out once
+// maxFailures is reached.
+type authLimiter struct {
+	mu          sync.Mutex
+	clients     map[string]*authFailures
+	lastSweep   time.Time
+	maxFailures int
+	lockout     time.Duration
+}
+
+func newAuthLimiter(maxFailures int, lockout time.Duration) *authLimiter {
+	return &authLimiter{
+		clients:     make(map[string]*authFailures),
+		maxFailures: maxFailures,
+		lockout:     lockout,
+	}
+}
+
+// check returns how long the client still has to wait if it is locked out
+// and otherwise the delay to apply before handling the request.
+func (l *authLimiter) check(ip string, now time.Time) (retryAfter time.Duration, delay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failures, ok := l.clients[ip]
+	if !ok {
+		return 0, 0
+	}
+	if now.Before(failures.lockedUntil) {
+		return failures.lockedUntil.Sub(now), 0
+	}
+	if l.expired(failures, now) {
+		// failures are forgotten after a quiet period
+		delete(l.clients, ip)
+		return 0, 0
+	}
+	delay = time.Duration(float64(authBaseDelay) * math.Pow(2, float64(failures.count-1)))
+	if delay > authMaxDelay {
+		delay = authMaxDelay
+	}
+	return 0, delay
+}
+
+// configure updates the thresholds without forgetting recorded failures.
+func (l *authLimiter) configure(maxFailures int, lockout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxFailures = maxFailures
+	l.lockout = lockout
+}
+
+// expired reports whether the failures of a client are forgotten. Must be
+// called with l.mu held.
+func (l *authLimiter) expired(failures *authFailures, now time.Time) bool {
+	return !now.Before(failures.lockedUntil) && now.Sub(failures.lastFailure) > l.lockout
+}
+
+// sweep removes the clients whose failures are forgotten, so that failures
+// from many different addresses do not pile up. Must be called with l.mu
+// held.
+func (l *authLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for ip, failures := range l.clients {
+		if l.expired(failures, now) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+func (l *authLimiter) fail(ip string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failures, ok := l.clients[ip]
+	if !ok {
+		if now.Sub(l.lastSweep) > authSweepInterval || len(l.clients) >= authMaxClients {
+			l.sweep(now)
+		}
+		if len(l.clients) >= authMaxClients {
+			l.evictOldest()
+		}
+		failures = &authFailures{}
+		l.clients[ip] = failures
+	}
+	failures.count++
+	failures.lastFailure = now
+	if failures.count >= l.maxFailures {
+		failures.count = 0
+		failures.lockedUntil = now.Add(l.lockout)
+		authLockoutsTotal.Inc()
+		logger.WithFields(logrus.Fields{
+			"client_ip":    ip,
+			"failures":     l.maxFailures,
+			"locked_until": failures.lockedUntil,
+		}).Warn("Locking out client after failed authentication attempts")
+	}
+}
+
+// evictOldest forgets the client with the oldest failure. Must be called
+// with l.mu held.
+func (l *authLimiter) evictOldest() {
+	oldestIP := ""
+	var oldest time.Time
+	for ip, failures := range l.clients {
+		if oldestIP == "" || failures.lastFailure.Before(oldest) {
+			oldestIP, oldest = ip, failures.lastFailure
+		}
+	}
+	delete(l.clients, oldestIP)
+}
+
+func (l *authLimiter) succeed(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, ip)
+}
+
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isTrusted(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// honoured when the request comes from a trusted proxy, in which case the
+// right-most address that is not a trusted proxy is used.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrusted(ip, trustedProxies) {
+		return host
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		candidate := strings.TrimSpace(forwarded[i])
+		candidateIP := net.ParseIP(candidate)
+		if candidateIP == nil {
+			break
+		}
+		host = candidate
+		if !isTrusted(candidateIP, trustedProxies) {
+			break
+		}
+	}
+	return host
+}
+
+// withAuthLimit wraps the authentication middlewares and records their
+// outcome for the client IP. Invalid API keys, signatures and share links
+// count as failures. The failures are only forgotten once a request has been
+// authenticated, requests that fail before, e.g. with a malformed path or
+// an oversized body, leave them untouched.
+func withAuthLimit(fn http.HandlerFunc, limiter *authLimiter, trustedProxies []*net.IPNet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, trustedProxies)
+		retryAfter, delay := limiter.check(ip, time.Now())
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			respondErr(w, r, http.StatusTooManyRequests, "too many failed authentication attempts")
+			return
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		fn(recorder, r)
+		switch {
+		case recorder.status == http.StatusUnauthorized || recorder.status == http.StatusForbidden:
+			limiter.fail(ip, time.Now())
+		case requestIdentity(r.Context()) != "":
+			limiter.succeed(ip)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logger is used for everything that does not belong to a request, request
+// handlers should use requestLogger instead.
+var logger = logrus.New()
+
+func init() {
+	logger.SetOutput(os.Stderr)
+	logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+}
+
+// configureLogger sets the log format ("logfmt" or "json") and enables debug
+// logging if requested.
+func configureLogger(format string, debug bool) error {
+	switch format {
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	case "logfmt":
+		logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+	default:
+		return errors.New("logFormat must be logfmt or json, got " + format)
+	}
+	if debug {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.InfoLevel)
+	}
+	return nil
+}
+
+const headerRequestID = "X-Request-ID"
+
+// requestInfo is shared by all middlewares of a request, so that the access
+// log written by the outermost one can include what the inner ones found out.
+type requestInfo struct {
+	id       string
+	route    string
+	identity string
+	logger   *logrus.Entry
+}
+
+var contextKeyRequestInfo = &contextKey{"request-info"}
+
+func getRequestInfo(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(contextKeyRequestInfo).(*requestInfo)
+	return info
+}
+
+// RequestID returns the ID of the request
+func RequestID(ctx context.Context) string {
+	if info := getRequestInfo(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// requestLogger returns a logger that adds the request ID to every line.
+func requestLogger(r *http.Request) *logrus.Entry {
+	return contextLogger(r.Context())
+}
+
+// contextLogger returns the logger of the request that ctx belongs to, so
+// that GitLab calls made for a request log its ID as well. Outside of
+// requests it returns the global logger.
+func contextLogger(ctx context.Context) *logrus.Entry {
+	if info := getRequestInfo(ctx); info != nil {
+		return info.logger
+	}
+	return logrus.NewEntry(logger)
+}
+
+// detachContext returns a context that is not canceled together with ctx
+// but still logs with the ID of its request.
+func detachContext(ctx context.Context) context.Context {
+	if info := getRequestInfo(ctx); info != nil {
+		return context.WithValue(context.Background(), contextKeyRequestInfo, info)
+	}
+	return context.Background()
+}
+
+func setRequestIdentity(ctx context.Context, identity string) {
+	if info := getRequestInfo(ctx); info != nil {
+		info.identity = identity
+	}
+}
+
+// requestIdentity returns who the request was authenticated as, empty if it
+// was not authenticated (yet).
+func requestIdentity(ctx context.Context) string {
+	if info := getRequestInfo(ctx); info != nil {
+		return info.identity
+	}
+	return ""
+}
+
+func setRequestRoute(ctx context.Context, route string) {
+	if info := getRequestInfo(ctx); info != nil {
+		info.route = route
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts IDs set by proxies or clients as long as they are
+// short and cannot mess up the log output.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestLogging assigns a request ID, taking over a valid X-Request-ID
+// header, and writes an access log line for every request.
+func (s *server) withRequestLogging(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(headerRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		info := &requestInfo{
+			id:     id,
+			logger: logger.WithField("request_id", id),
+		}
+		w.Header().Set(headerRequestID, id)
+		r = r.WithContext(context.WithValue(r.Context(), contextKeyRequestInfo, info))
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(recorder, r)
+
+		fields := logrus.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"route":       info.route,
+			"status":      recorder.status,
+			"duration_ms": time.Since(start).Milliseconds(),
+			"client_ip":   clientIP(r, s.trustedNetworks()),
+		}
+		if info.identity != "" {
+			fields["identity"] = info.identity
+		}
+		info.logger.WithFields(fields).Info("request")
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "tdr_diff"
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	gitlabRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gitlab_requests_total",
+		Help:      "Number of GitLab API calls by operation and outcome.",
+	}, []string{"operation", "outcome"})
+	gitlabRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "gitlab_request_duration_seconds",
+		Help:      "Duration of GitLab API calls by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	refreshTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "refresh_total",
+		Help:      "Number of project refreshes by outcome (success, partial or error).",
+	}, []string{"outcome"})
+	refreshDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "refresh_duration_seconds",
+		Help:      "Duration of project refreshes.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	cachedProjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cached_projects",
+		Help:      "Number of cached projects per group.",
+	}, []string{"group"})
+	pipelinesTriggeredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pipelines_triggered_total",
+		Help:      "Number of diff pipelines triggered per group.",
+	}, []string{"group"})
+	gitlabRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gitlab_retries_total",
+		Help:      "Number of retried GitLab API calls by operation.",
+	}, []string{"operation"})
+	gitlabRateLimitLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "gitlab_rate_limit_limit",
+		Help:      "Number of GitLab API calls allowed per period as last reported by GitLab.",
+	})
+	gitlabRateLimitRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "gitlab_rate_limit_remaining",
+		Help:      "Number of GitLab API calls left in the current period as last reported by GitLab.",
+	})
+	gitlabRateLimitReset = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "gitlab_rate_limit_reset_timestamp_seconds",
+		Help:      "Unix time at which the GitLab rate limit is reset.",
+	})
+	gitlabCircuitOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "gitlab_circuit_open",
+		Help:      "Whether the circuit breaker stops calls to GitLab (1) or not (0).",
+	})
+	cacheLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_lookups_total",
+		Help:      "Number of lookups of cached GitLab data by result (hit, miss or shared with a concurrent fetch).",
+	}, []string{"result"})
+	authLockoutsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_lockouts_total",
+		Help:      "Number of clients locked out after failed authentication attempts.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		gitlabRequestsTotal,
+		gitlabRequestDuration,
+		gitlabRetriesTotal,
+		gitlabRateLimitLimit,
+		gitlabRateLimitRemaining,
+		gitlabRateLimitReset,
+		gitlabCircuitOpen,
+		cacheLookupsTotal,
+		refreshTotal,
+		refreshDuration,
+		cachedProjects,
+		pipelinesTriggeredTotal,
+		authLockoutsTotal,
+	)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// observeGitLab starts timing a GitLab API call. The returned function
+// records the call with its error once it is done, e.g.
+//
+//	done := observeGitLab("ListCommits")
+//	commits, response, err := s.gl.Commits.ListCommits(projectID, opts)
+//	done(err)
+func observeGitLab(operation string) func(error) {
+	start := time.Now()
+	return func(err error) {
+		gitlabRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		gitlabRequestsTotal.WithLabelValues(operation, outcome(err)).Inc()
+	}
+}
+
+func observeRefresh(start time.Time, projects map[string][]gitlabProjectList, groupErrors map[string]error) {
+	refreshDuration.Observe(time.Since(start).Seconds())
+	switch {
+	case len(groupErrors) == 0:
+		refreshTotal.WithLabelValues("success").Inc()
+	case len(projects) == 0:
+		refreshTotal.WithLabelValues("error").Inc()
+	default:
+		refreshTotal.WithLabelValues("partial").Inc()
+	}
+	for group, groupProjects := range projects {
+		cachedProjects.WithLabelValues(group).Set(float64(len(groupProjects)))
+	}
+}
+
+// instrument is a mux middleware recording request counts and latency by
+// route template, so that path parameters do not blow up the label space.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		setRequestRoute(r.Context(), route)
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// gitlabConcurrency caps the number of concurrent GitLab calls made through
+// gitlabRequest, shared by all handlers and the refresher. It is replaced on
+// startup with the configured size.
+var gitlabConcurrency = semaphore.NewWeighted(8)
+
+// fetchPages calls fetch for page 1 to learn the number of pages and then
+// for the remaining pages, up to maxPages, with at most workers calls at a
+// time. fetch returns the total number of pages. The first error cancels the
+// remaining calls.
+func fetchPages(ctx context.Context, maxPages, workers int, fetch func(ctx context.Context, page int) (int, error)) error {
+	totalPages, err := fetch(ctx, 1)
+	if err != nil {
+		return err
+	}
+	if totalPages > maxPages {
+		totalPages = maxPages
+	}
+	if totalPages <= 1 {
+		return nil
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	pages := make(chan int)
+	for i := 0; i < workers && i < totalPages-1; i++ {
+		group.Go(func() error {
+			for page := range pages {
+				if _, err := fetch(ctx, page); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	group.Go(func() error {
+		defer close(pages)
+		for page := 2; page <= totalPages; page++ {
+			select {
+			case pages <- page:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		return nil
+	})
+	return group.Wait()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Headers GitLab uses to report the rate limit of the token.
+const (
+	headerRateLimit     = "RateLimit-Limit"
+	headerRateRemaining = "RateLimit-Remaining"
+	headerRateReset     = "RateLimit-Reset"
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// gitlabRateLimit is the rate-limit state GitLab reported with the last
+// response.
+type gitlabRateLimit struct {
+	mu        sync.RWMutex
+	known     bool
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+func (l *gitlabRateLimit) update(header http.Header) {
+	limit, err := strconv.Atoi(header.Get(headerRateLimit))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(header.Get(headerRateRemaining))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get(headerRateReset), 10, 64)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	l.known = true
+	l.limit = limit
+	l.remaining = remaining
+	l.reset = time.Unix(reset, 0)
+	l.mu.Unlock()
+
+	gitlabRateLimitLimit.Set(float64(limit))
+	gitlabRateLimitRemaining.Set(float64(remaining))
+	gitlabRateLimitReset.Set(float64(reset))
+}
+
+// low reports whether less than reservePercent of the budget is left and
+// when the budget is reset.
+func (l *gitlabRateLimit) low(reservePercent int) (bool, time.Time) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if !l.known || time.Now().After(l.reset) {
+		return false, time.Time{}
+	}
+	return l.remaining*100 < l.limit*reservePercent, l.reset
+}
+
+func (l *gitlabRateLimit) check() healthCheck {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	switch {
+	case !l.known:
+		return healthCheck{OK: true, Message: "no rate limit reported"}
+	case l.remaining <= 0 && time.Now().Before(l.reset):
+		return healthCheck{OK: false, Message: "rate limit exhausted until " + l.reset.UTC().Format(time.RFC3339)}
+	default:
+		return healthCheck{OK: true, Message: strconv.Itoa(l.remaining) + " of " + strconv.Itoa(l.limit) + " requests left"}
+	}
+}
+
+// rateLimitTransport records the rate-limit headers of all GitLab responses.
+// Requests without a deadline, like the one go-gitlab makes without a
+// context to set up its rate limiter, time out after timeout.
+type rateLimitTransport struct {
+	next      http.RoundTripper
+	rateLimit *gitlabRateLimit
+	timeout   time.Duration
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if _, ok := req.Context().Deadline(); !ok && t.timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), t.timeout)
+		req = req.WithContext(ctx)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		cancel()
+		return resp, err
+	}
+	t.rateLimit.update(resp.Header)
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the timeout of a request once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// gitlabCall is stored in the context of a GitLab call so that the retry
+// policy knows which operation it retries.
+type gitlabCall struct {
+	operation string
+	retries   int
+}
+
+var contextKeyGitLabCall = &contextKey{"gitlab-call"}
+
+// gitlabWriteOperations change state in GitLab and are never retried.
+var gitlabWriteOperations = map[string]bool{
+	"RunPipelineTrigger": true,
+}
+
+// retryPolicy decides which GitLab calls are retried and how long to wait in
+// between. It replaces the defaults of go-gitlab, which retry every call on
+// 429 and 5xx, including triggers.
+type retryPolicy struct {
+	mu         sync.RWMutex
+	maxRetries int
+	waitMin    time.Duration
+	waitMax    time.Duration
+}
+
+func newRetryPolicy(maxRetries int, waitMin, waitMax time.Duration) *retryPolicy {
+	p := &retryPolicy{}
+	p.configure(maxRetries, waitMin, waitMax)
+	return p
+}
+
+func (p *retryPolicy) configure(maxRetries int, waitMin, waitMax time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxRetries = maxRetries
+	p.waitMin = waitMin
+	p.waitMax = waitMax
+}
+
+// checkRetry retries idempotent calls on connection errors, 429 and 5xx.
+func (p *retryPolicy) checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return false, nil
+	}
+	call, ok := ctx.Value(contextKeyGitLabCall).(*gitlabCall)
+	if !ok || gitlabWriteOperations[call.operation] {
+		return false, err
+	}
+	p.mu.RLock()
+	maxRetries := p.maxRetries
+	p.mu.RUnlock()
+	if call.retries >= maxRetries {
+		return false, err
+	}
+	call.retries++
+	gitlabRetriesTotal.WithLabelValues(call.operation).Inc()
+	fields := logrus.Fields{"operation": call.operation, "retry": call.retries}
+	if err != nil {
+		contextLogger(ctx).WithFields(fields).WithError(err).Debug("Retrying GitLab call")
+	} else {
+		contextLogger(ctx).WithFields(fields).WithField("status", resp.StatusCode).Debug("Retrying GitLab call")
+	}
+	return true, nil
+}
+
+// backoff waits exponentially longer with every attempt, with jitter so that
+// retries of concurrent calls do not hit GitLab at the same time. When rate
+// limited, it waits until the limit is reset, but never longer than the
+// maximum wait.
+func (p *retryPolicy) backoff(_, _ time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	p.mu.RLock()
+	waitMin, waitMax := p.waitMin, p.waitMax
+	p.mu.RUnlock()
+
+	wait := waitMin << uint(attemptNum)
+	if wait > waitMax || wait <= 0 {
+		wait = waitMax
+	}
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if reset, err := strconv.ParseInt(resp.Header.Get(headerRateReset), 10, 64); err == nil {
+			if untilReset := time.Until(time.Unix(reset, 0)); untilReset > wait {
+				wait = untilReset
+			}
+		} else if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			if retryAfter := time.Duration(seconds) * time.Second; retryAfter > wait {
+				wait = retryAfter
+			}
+		}
+		if wait > waitMax {
+			wait = waitMax
+		}
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// waitForRateLimit delays the background refresh while less than the
+// reserved share of the GitLab rate limit is left, so that calls made for
+// users still get through. It returns false if the server is shutting down.
+func (s *server) waitForRateLimit() bool {
+	low, reset := s.rateLimit.low(s.config().gitlabRateLimitReservePercent)
+	if !low {
+		return true
+	}
+	wait := time.Until(reset)
+	logger.WithField("wait", wait.Round(time.Second)).Warn("GitLab rate limit almost used up, slowing down refresh")
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stopping:
+		return false
+	}
+}
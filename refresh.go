@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// groupRefreshStatus describes the outcome of the refreshes of one group.
+type groupRefreshStatus struct {
+	LastSuccess  *time.Time `json:"lastSuccess"`
+	LastAttempt  *time.Time `json:"lastAttempt"`
+	LastError    string     `json:"lastError,omitempty"`
+	ProjectCount int        `json:"projectCount"`
+}
+
+// applyProjectUpdate merges the result of updateProjects for the groups in
+// fetchedGroupIDs into the cache. Groups that failed keep their previous
+// projects. Groups that have been added since the fetch started keep their
+// status until the next refresh, groups that have been removed are dropped.
+// Must be called with stateMu held.
+func applyProjectUpdate(fetchedGroupIDs map[string]int, projects map[string][]gitlabProjectList, groupErrors map[string]error, attempted time.Time) {
+	newAllProjects := make(map[string][]gitlabProjectList)
+	newGroupStatus := make(map[string]*groupRefreshStatus)
+	loaded := true
+	for group := range groupIDs {
+		status, ok := groupStatus[group]
+		if !ok {
+			status = &groupRefreshStatus{}
+		}
+		if _, fetched := fetchedGroupIDs[group]; !fetched {
+			newAllProjects[group] = allProjects[group]
+			if status.LastSuccess == nil {
+				loaded = false
+			}
+			newGroupStatus[group] = status
+			continue
+		}
+		attemptedAt := attempted
+		status.LastAttempt = &attemptedAt
+		if err, failed := groupErrors[group]; failed {
+			status.LastError = err.Error()
+			newAllProjects[group] = allProjects[group]
+		} else {
+			status.LastSuccess = &attemptedAt
+			status.LastError = ""
+			newAllProjects[group] = projects[group]
+			lastUpdated = attempted
+		}
+		status.ProjectCount = len(newAllProjects[group])
+		if status.LastSuccess == nil {
+			loaded = false
+		}
+		newGroupStatus[group] = status
+	}
+	allProjects = newAllProjects
+	groupStatus = newGroupStatus
+	projectsLoaded = loaded && len(groupIDs) > 0
+}
+
+// refreshProjects updates the cached projects of all groups. Groups that
+// fail to update keep their previous projects.
+func (s *server) refreshProjects() {
+	stateMu.RLock()
+	currentGroupIDs := groupIDs
+	stateMu.RUnlock()
+
+	logger.Info("Updating projects")
+	start := time.Now()
+	projects, groupErrors := s.updateProjects(context.Background(), currentGroupIDs)
+	stateMu.Lock()
+	applyProjectUpdate(currentGroupIDs, projects, groupErrors, start)
+	stateMu.Unlock()
+	observeRefresh(start, projects, groupErrors)
+	s.requestTagCheck()
+	if len(groupErrors) > 0 {
+		logger.WithField("failed_groups", len(groupErrors)).Error("Updating projects failed for some groups")
+		return
+	}
+	logger.WithField("last_updated", start).Info("Done updating projects")
+}
+
+// runRefresher refreshes the projects now and then every interval. Sending a
+// new interval on s.refreshReset refreshes immediately and restarts the
+// ticker with it. It returns once the server is shutting down.
+func (s *server) runRefresher(interval time.Duration) {
+	defer close(s.refresherDone)
+	s.refreshProjects()
+	ticker := time.NewTicker(interval)
+	defer func() { ticker.Stop() }()
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case <-ticker.C:
+			s.refreshProjects()
+		case interval = <-s.refreshReset:
+			ticker.Stop()
+			ticker = time.NewTicker(interval)
+			s.refreshProjects()
+		}
+	}
+}
+
+// resetRefresher asks the refresher to refresh now and continue with the
+// given interval. A pending reset is replaced.
+func (s *server) resetRefresher(interval time.Duration) {
+	for {
+		select {
+		case s.refreshReset <- interval:
+			return
+		default:
+		}
+		select {
+		case <-s.refreshReset:
+		default:
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// secretFields are never logged, only whether they changed.
+var secretFields = map[string]bool{
+	"gitlabToken":     true,
+	"triggerToken":    true,
+	"apiToken":        true,
+	"hmacSecret":      true,
+	"shareLinkSecret": true,
+}
+
+// restartFields cannot be changed without restarting the server.
+var restartFields = map[string]bool{
+	"address":               true,
+	"gitlabURL":             true,
+	"gitlabToken":           true,
+	"gitlabProject":         true,
+	"auditLogPath":          true,
+	"auditLogMaxBytes":      true,
+	"auditLogMaxBackups":    true,
+	"historyPath":           true,
+	"requestTimeoutSeconds": true,
+	"gitlabMaxConcurrency":  true,
+}
+
+// changedFields returns the names of the configuration fields that differ.
+func changedFields(old, new *Configuration) []string {
+	var changed []string
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(new).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		if fmt.Sprint(oldValue.Field(i)) != fmt.Sprint(newValue.Field(i)) {
+			changed = append(changed, oldValue.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
+
+func logConfigChanges(old, new *Configuration, changed []string) {
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(new).Elem()
+	for _, name := range changed {
+		switch {
+		case secretFields[name]:
+			logger.WithField("field", name).Info("Config changed")
+		default:
+			logger.WithFields(logrus.Fields{
+				"field": name,
+				"old":   fmt.Sprint(oldValue.FieldByName(name)),
+				"new":   fmt.Sprint(newValue.FieldByName(name)),
+			}).Info("Config changed")
+		}
+		if restartFields[name] {
+			logger.WithField("field", name).Warn("Config change only takes effect after a restart")
+		}
+	}
+}
+
+// reloadConfig validates the current viper configuration and swaps it in.
+// If validation fails the running configuration is kept.
+func (s *server) reloadConfig(v *viper.Viper) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	newConfiguration, err := validateAndSetConfig(v)
+	if err != nil {
+		return err
+	}
+	old := s.config()
+	changed := changedFields(old, &newConfiguration)
+	if len(changed) == 0 {
+		logger.Info("Config reloaded, nothing changed")
+		return nil
+	}
+	trustedProxies, err := parseTrustedProxies(newConfiguration.trustedProxies)
+	if err != nil {
+		return err
+	}
+	groupsChanged := fmt.Sprint(old.groupIds) != fmt.Sprint(newConfiguration.groupIds)
+	var newGroupIDs map[string]int
+	if groupsChanged {
+		newGroupIDs, err = validateSubgroups(context.Background(), tdrGroupID, s.gl, newConfiguration)
+		if err != nil {
+			return err
+		}
+	}
+	logConfigChanges(old, &newConfiguration, changed)
+
+	s.mu.Lock()
+	s.configuration = &newConfiguration
+	if old.hmacSecret != newConfiguration.hmacSecret || old.hmacMaxSkewSeconds != newConfiguration.hmacMaxSkewSeconds {
+		s.signer = newRequestSigner(newConfiguration.hmacSecret, time.Duration(newConfiguration.hmacMaxSkewSeconds)*time.Second)
+	}
+	s.shareSigner = newShareSigner(newConfiguration.shareLinkSecret, time.Duration(newConfiguration.shareLinkMaxHours)*time.Hour)
+	s.trustedProxies = trustedProxies
+	s.mu.Unlock()
+
+	if err := configureLogger(newConfiguration.logFormat, newConfiguration.debug); err != nil {
+		logger.WithError(err).Error("Configuring logger failed")
+	}
+	s.authLimiter.configure(newConfiguration.authMaxFailures, time.Duration(newConfiguration.authLockoutSeconds)*time.Second)
+	s.cors.configure(newConfiguration.frontendOrigin, newConfiguration.allowedOrigins, newConfiguration.corsAllowCredentials)
+	retryWaitMin, retryWaitMax := newConfiguration.gitlabRetryWait()
+	s.retries.configure(newConfiguration.gitlabRetryMax, retryWaitMin, retryWaitMax)
+	s.cache.configure(newConfiguration.gitlabCacheMaxEntries, time.Duration(newConfiguration.gitlabCacheSeconds)*time.Second)
+	gitlabBreaker.configure(newConfiguration.gitlabBreakerFailures, time.Duration(newConfiguration.gitlabBreakerProbeSeconds)*time.Second)
+
+	interval := time.Duration(newConfiguration.updateIntervalSeconds) * time.Second
+	if groupsChanged {
+		stateMu.Lock()
+		groupIDs = newGroupIDs
+		groupsResolved = true
+		projTypes = newTDRTypes(newConfiguration.groupIds)
+		stateMu.Unlock()
+		logger.WithField("group_ids", newGroupIDs).Info("Groups changed")
+		s.resetRefresher(interval)
+	} else if old.updateIntervalSeconds != newConfiguration.updateIntervalSeconds {
+		s.resetRefresher(interval)
+	}
+	return nil
+}
+
+// watchConfig reloads the configuration when the config file changes. The
+// directory is watched, so that the atomic symlink swaps of mounted config
+// maps are noticed as well.
+func (s *server) watchConfig(configFile string) {
+	if configFile == "" {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.WithError(err).Error("Watching config file failed")
+		return
+	}
+	configFile = filepath.Clean(configFile)
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		logger.WithError(err).Error("Watching config file failed")
+		watcher.Close()
+		return
+	}
+	realConfigFile, _ := filepath.EvalSymlinks(configFile)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				currentConfigFile, _ := filepath.EvalSymlinks(configFile)
+				written := filepath.Clean(event.Name) == configFile && event.Op&(fsnotify.Write|fsnotify.Create) != 0
+				swapped := currentConfigFile != "" && currentConfigFile != realConfigFile
+				if !written && !swapped {
+					continue
+				}
+				realConfigFile = currentConfigFile
+				logger.WithField("file", event.Name).Info("Config file changed")
+				s.reload()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.WithError(err).Error("Watching config file failed")
+			}
+		}
+	}()
+}
+
+// reload reads the config file and the environment into a new viper
+// instance and reloads the configuration. viper is not safe for concurrent
+// use, so every reload gets its own instance.
+func (s *server) reload() {
+	v, err := readConfig()
+	if err != nil {
+		logger.WithError(err).Error("Config reload failed, keeping previous configuration")
+		return
+	}
+	if err := s.reloadConfig(v); err != nil {
+		logger.WithError(err).Error("Config reload failed, keeping previous configuration")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	resolveMinBackoff = 5 * time.Second
+	resolveMaxBackoff = 5 * time.Minute
+)
+
+// getPipelineProjectID returns the ID of the pipeline project, or 0 if it
+// has not been resolved yet.
+func getPipelineProjectID() int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return pipelineProjectID
+}
+
+// resolvePipelineProject looks up the project running the diff pipelines.
+func (s *server) resolvePipelineProject() error {
+	withContext, done := s.gitlabRequest(context.Background(), "GetProject")
+	pipelineProject, _, err := s.gl.Projects.GetProject(pipelineProjectPath, nil, withContext)
+	err = done(err)
+	if err != nil {
+		return err
+	}
+	stateMu.Lock()
+	pipelineProjectID = pipelineProject.ID
+	stateMu.Unlock()
+	logger.WithField("pipeline_project_id", pipelineProject.ID).Info("Resolved pipeline project")
+	return nil
+}
+
+// resolveGroups looks up the IDs of the configured groups. Groups that were
+// found are used even if others are missing.
+func (s *server) resolveGroups() error {
+	configuration := s.config()
+	newGroupIDs, err := validateSubgroups(context.Background(), tdrGroupID, s.gl, *configuration)
+	if len(newGroupIDs) > 0 {
+		stateMu.Lock()
+		groupIDs = newGroupIDs
+		groupsResolved = err == nil
+		stateMu.Unlock()
+		logger.WithField("group_ids", newGroupIDs).Info("Resolved groups")
+	}
+	if err == nil && len(newGroupIDs) == 0 {
+		err = errors.New("no groups found")
+	}
+	return err
+}
+
+func dependenciesResolved() bool {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return pipelineProjectID != 0 && groupsResolved
+}
+
+// resolveDependencies resolves the pipeline project and the groups, and
+// keeps retrying with exponential backoff until both succeeded. Until then
+// the server runs in degraded mode: cached data is served, but pipelines
+// cannot be triggered. It runs in the background so that the server listens
+// even if GitLab hangs.
+func (s *server) resolveDependencies() {
+	backoff := resolveMinBackoff
+	for {
+		if getPipelineProjectID() == 0 {
+			if err := s.resolvePipelineProject(); err != nil {
+				logger.WithError(err).Error("Getting pipeline project failed")
+			}
+		}
+		stateMu.RLock()
+		currentGroupsResolved := groupsResolved
+		stateMu.RUnlock()
+		if !currentGroupsResolved {
+			if err := s.resolveGroups(); err != nil {
+				logger.WithError(err).Error("Validating subgroups failed")
+			}
+			// fetch the projects of newly found groups right away
+			s.resetRefresher(time.Duration(s.config().updateIntervalSeconds) * time.Second)
+		}
+		if dependenciesResolved() {
+			return
+		}
+
+		logger.WithField("retry_in", backoff).Warn("Running in degraded mode, retrying to resolve GitLab dependencies")
+		select {
+		case <-s.stopping:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > resolveMaxBackoff {
+			backoff = resolveMaxBackoff
+		}
+	}
+}
+
+// requirePipelineProject rejects requests that need the pipeline project
+// while it has not been resolved.
+func requirePipelineProject(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if getPipelineProjectID() == 0 {
+			w.Header().Set("Retry-After", "30")
+			respondErr(w, r, http.StatusServiceUnavailable, "pipeline project not available yet, GitLab might be unreachable")
+			return
+		}
+		fn(w, r)
+	}
+}
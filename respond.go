@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 )
 
@@ -29,11 +28,17 @@ func respond(w http.ResponseWriter, r *http.Request,
 func respondErr(w http.ResponseWriter, r *http.Request,
 	status int, args ...interface{},
 ) {
-	log.Print("Error: ")
-	log.Println(args...)
+	message := fmt.Sprint(args...)
+	entry := requestLogger(r).WithField("status", status)
+	if status >= http.StatusInternalServerError {
+		entry.Error(message)
+	} else {
+		entry.Warn(message)
+	}
 	respond(w, r, status, map[string]interface{}{
 		"error": map[string]interface{}{
-			"message": fmt.Sprint(args...),
+			"message":    message,
+			"request_id": RequestID(r.Context()),
 		},
 	})
 }
@@ -43,3 +48,14 @@ func respondHTTPErr(w http.ResponseWriter, r *http.Request,
 ) {
 	respondErr(w, r, status, http.StatusText(status))
 }
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -1,18 +1,61 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"time"
+
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func (s *server) newRouter(apiToken string, frontendOrigin string) *mux.Router {
+func (s *server) newRouter() *mux.Router {
+	// protected routes accept either a signed request or the static API token,
+	// the middlewares are set up per request to pick up configuration changes
+	protect := func(fn http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			auth := withSignature(withAPIKey(fn, s.config().apiToken), s.requestSigner())
+			withBodyLimit(withAuthLimit(auth, s.authLimiter, s.trustedNetworks()), maxRequestBodyBytes)(w, r)
+		}
+	}
+	// shared routes are authenticated by the signed link, failures count
+	// towards the lockout of the client like invalid API keys
+	shared := func(fn http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			withAuthLimit(fn, s.authLimiter, s.trustedNetworks())(w, r)
+		}
+	}
 	r := mux.NewRouter()
+	r.Use(instrument)
+	r.Handle("/metrics", promhttp.Handler())
 	r.HandleFunc("/ping", s.handlePing())
+	r.HandleFunc("/healthz", s.handleHealthz())
+	r.HandleFunc("/readyz", s.handleReadyz())
 	r.HandleFunc("/lastUpdated", s.handleLastUpdated())
 	r.HandleFunc("/version", s.handleVersion())
-	r.HandleFunc("/types", withCORS(withAPIKey(s.handleTypes(), apiToken), frontendOrigin))
-	r.HandleFunc("/projects/{id}", withCORS(withAPIKey(s.handleProjects(), apiToken), frontendOrigin))
-	r.HandleFunc("/commits/{group}/{id}", withCORS(withAPIKey(s.handleCommits(), apiToken), frontendOrigin))
-	r.HandleFunc("/status/pipeline/{id}", withCORS(withAPIKey(s.handlePipelineStatus(), apiToken), frontendOrigin))
-	r.HandleFunc("/trigger", withCORS(withAPIKey(s.handleTrigger(), apiToken), frontendOrigin)).Methods("POST")
+	r.HandleFunc("/types", protect(s.handleTypes()))
+	r.HandleFunc("/projects/{id}", protect(s.handleProjects()))
+	r.HandleFunc("/commits/{group}/{id}", protect(s.handleCommits()))
+	r.HandleFunc("/tags/{group}/{id}", protect(s.handleTags()))
+	r.HandleFunc("/branches/{group}/{id}", protect(s.handleBranches()))
+	r.HandleFunc("/compare/{group}/{id}", protect(s.handleCompare()))
+	r.HandleFunc("/textdiff/{group}/{id}", protect(s.handleTextDiff()))
+	r.HandleFunc("/suggest/{group}/{id}", protect(s.handleSuggest()))
+	r.HandleFunc("/status/pipeline/{id}", protect(requirePipelineProject(s.handlePipelineStatus())))
+	r.HandleFunc("/trigger", protect(requirePipelineProject(requireGitLab(s.handleTrigger())))).Methods("POST")
+	r.HandleFunc("/share", protect(requirePipelineProject(s.handleShare()))).Methods("POST")
+	r.HandleFunc("/shared/pipeline/{id}/status", shared(requirePipelineProject(s.handleSharedStatus())))
+	r.HandleFunc("/shared/pipeline/{id}/artifact", shared(requirePipelineProject(s.handleSharedArtifact())))
+	r.HandleFunc("/admin/audit", protect(s.handleAudit()))
 	return r
 }
+
+// withRequestTimeout sets a deadline for the GitLab calls made while handling
+// a request.
+func withRequestTimeout(h http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -3,13 +3,17 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/hashicorp/go-cleanhttp"
 	"github.com/xanzy/go-gitlab"
+	"golang.org/x/sync/semaphore"
 )
 
 var (
@@ -18,7 +22,8 @@ var (
 )
 
 var (
-	flgVersion bool // for flag parsing
+	flgVersion     bool // for flag parsing
+	flgCheckConfig bool
 )
 
 type tdrTypes struct {
@@ -27,14 +32,34 @@ type tdrTypes struct {
 
 var (
 	lastUpdated       time.Time                      // when projects have last been updated
-	pipelineProjectID int                            // needed for interacting with GitLab API
+	pipelineProjectID int                            // needed for interacting with GitLab API, 0 until resolved
 	allProjects       map[string][]gitlabProjectList // all GitLab projects
 	projTypes         *tdrTypes                      // all types available in tdr repository
 	groupIDs          map[string]int                 // all available group IDs
+	groupsResolved    bool                           // whether all configured groups have been found
+	projectsLoaded    bool                           // whether projects of all groups have been loaded successfully once
+	groupStatus       map[string]*groupRefreshStatus // refresh status per group
+	stateMu           sync.RWMutex                   // guards the variables above that change at runtime
 )
 
+const (
+	tdrGroupID          = 16284             // this is the tdr group
+	pipelineProjectPath = "clange/tdr-diff" // runs the diff pipelines
+)
+
+func newTDRTypes(groupIds []string) *tdrTypes {
+	types := make([]string, 0, len(groupIds))
+	for _, key := range groupIds {
+		types = append(types, key)
+	}
+	return &tdrTypes{
+		Names: types,
+	}
+}
+
 func parseCmdLineFlags() {
 	flag.BoolVar(&flgVersion, "version", false, "if true, print version and exit")
+	flag.BoolVar(&flgCheckConfig, "check-config", false, "if true, validate the configuration, print it redacted and exit")
 	flag.Parse()
 	if flgVersion {
 		fmt.Printf("Build snapshot tag %s%s\n", buildTime, sha1ver)
@@ -43,106 +68,196 @@ func parseCmdLineFlags() {
 }
 
 type server struct {
-	gl            *gitlab.Client
-	configuration *Configuration
+	gl             *gitlab.Client
+	auditLog       *auditLog
+	history        *historyStore
+	tagWatcher     *tagWatcher
+	tagCheck       chan struct{} // requests to look for new tags
+	rateLimit      *gitlabRateLimit
+	retries        *retryPolicy
+	lastKnown      *lastKnownCache // last successful responses, served while GitLab is unavailable
+	cache          *lruCache       // short-lived cache of GitLab data
+	flights        fetchGroup      // coalesces concurrent fetches of the same data
+	authLimiter    *authLimiter
+	cors           *corsPolicy
+	refreshReset   chan time.Duration
+	stopping       chan struct{} // closed when shutting down
+	refresherDone  chan struct{}
+	tagWatcherDone chan struct{}
+	gitlabProbe    gitlabProbe
+
+	reloadMu sync.Mutex   // serialises config reloads
+	mu       sync.RWMutex // guards the fields below, which are swapped on reload
+
+	configuration  *Configuration
+	signer         *requestSigner // nil if request signing is disabled
+	shareSigner    *shareSigner   // nil if share links are disabled
+	trustedProxies []*net.IPNet
+}
+
+func (s *server) config() *Configuration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.configuration
+}
+
+func (s *server) requestSigner() *requestSigner {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.signer
+}
+
+func (s *server) shareLinks() *shareSigner {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shareSigner
+}
+
+func (s *server) trustedNetworks() []*net.IPNet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.trustedProxies
 }
 
 func main() {
 
 	parseCmdLineFlags()
-	log.Printf("Build snapshot tag %s%s\n", buildTime, sha1ver)
+	logger.Infof("Build snapshot tag %s%s", buildTime, sha1ver)
 
 	v1, err := readConfig()
 	if err != nil {
-		log.Panicln("Configuration error", err)
+		logger.WithError(err).Panic("Configuration error")
+	}
+
+	if flgCheckConfig {
+		os.Exit(checkConfig(v1))
 	}
 
 	configuration, err := validateAndSetConfig(v1)
 	if err != nil {
-		log.Panicln(err)
+		logger.WithError(err).Panic("Invalid configuration")
 	}
+	configureLogger(configuration.logFormat, configuration.debug)
+	logger.WithFields(configFields(configuration)).Info("Configuration loaded")
 
-	gl, err := gitlab.NewClient(configuration.gitlabToken, gitlab.WithBaseURL(configuration.gitlabURL))
+	gitlabConcurrency = semaphore.NewWeighted(int64(configuration.gitlabMaxConcurrency))
+	gitlabBreaker.configure(configuration.gitlabBreakerFailures, time.Duration(configuration.gitlabBreakerProbeSeconds)*time.Second)
+	rateLimit := &gitlabRateLimit{}
+	retryWaitMin, retryWaitMax := configuration.gitlabRetryWait()
+	retries := newRetryPolicy(configuration.gitlabRetryMax, retryWaitMin, retryWaitMax)
+	gl, err := gitlab.NewClient(configuration.gitlabToken,
+		gitlab.WithBaseURL(configuration.gitlabURL),
+		gitlab.WithHTTPClient(&http.Client{
+			Transport: &rateLimitTransport{
+				next:      cleanhttp.DefaultPooledTransport(),
+				rateLimit: rateLimit,
+				timeout:   time.Duration(configuration.gitlabTimeoutSeconds) * time.Second,
+			},
+		}),
+		gitlab.WithCustomRetry(retries.checkRetry),
+		gitlab.WithCustomBackoff(retries.backoff),
+	)
 	if err != nil {
-		log.Panicln(err)
+		logger.WithError(err).Panic("Creating GitLab client failed")
 	}
 
-	s := &server{
-		gl:            gl,
-		configuration: &configuration,
+	auditLog, err := newAuditLog(configuration.auditLogPath, configuration.auditLogMaxBytes, configuration.auditLogMaxBackups)
+	if err != nil {
+		// the working directory is read-only on OpenShift
+		logger.WithError(err).WithField("path", configuration.auditLogPath).Panic("Opening audit log failed, set auditLogPath to a writable location such as a mounted volume")
 	}
 
-	pipelineProject, _, err := gl.Projects.GetProject("clange/tdr-diff", nil)
+	history, err := newHistoryStore(configuration.historyPath)
 	if err != nil {
-		log.Print(err)
+		logger.WithError(err).Panic("Opening history failed")
 	}
-	pipelineProjectID = pipelineProject.ID
-	log.Println("Pipeline project ID:", pipelineProjectID)
 
-	groupIDs, err = validateSubgroups(16284, gl, configuration) // this is the tdr group
+	trustedProxies, err := parseTrustedProxies(configuration.trustedProxies)
 	if err != nil {
-		log.Print(err)
+		logger.WithError(err).Panic("Invalid trusted proxies")
+	}
+
+	s := &server{
+		gl:             gl,
+		auditLog:       auditLog,
+		history:        history,
+		tagWatcher:     newTagWatcher(),
+		tagCheck:       make(chan struct{}, 1),
+		rateLimit:      rateLimit,
+		retries:        retries,
+		lastKnown:      newLastKnownCache(),
+		cache:          newLRUCache(configuration.gitlabCacheMaxEntries, time.Duration(configuration.gitlabCacheSeconds)*time.Second),
+		authLimiter:    newAuthLimiter(configuration.authMaxFailures, time.Duration(configuration.authLockoutSeconds)*time.Second),
+		cors:           newCORSPolicy(configuration.frontendOrigin, configuration.allowedOrigins, configuration.corsAllowCredentials),
+		refreshReset:   make(chan time.Duration, 1),
+		stopping:       make(chan struct{}),
+		refresherDone:  make(chan struct{}),
+		tagWatcherDone: make(chan struct{}),
+		configuration:  &configuration,
+		signer:         newRequestSigner(configuration.hmacSecret, time.Duration(configuration.hmacMaxSkewSeconds)*time.Second),
+		shareSigner:    newShareSigner(configuration.shareLinkSecret, time.Duration(configuration.shareLinkMaxHours)*time.Hour),
+		trustedProxies: trustedProxies,
 	}
-	log.Println("Group IDs:", groupIDs)
 
-	allProjects, err = updateProjects(groupIDs, gl)
-	lastUpdated = time.Now()
-	ticker := time.NewTicker(time.Duration(configuration.updateIntervalSeconds) * time.Second)
+	projTypes = newTDRTypes(configuration.groupIds)
+	logger.WithField("types", projTypes.Names).Info("Available types")
+
+	s.watchConfig(v1.ConfigFileUsed())
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		for range ticker.C {
-			log.Println("updating...")
-			tempAllProjects, err := updateProjects(groupIDs, gl)
-			if err != nil {
-				log.Println("Updating projects failed", err)
-				continue
-			}
-			lastUpdated = time.Now()
-			allProjects = tempAllProjects
-			log.Println("Done updating at", lastUpdated)
+		for range hup {
+			logger.Info("Received SIGHUP, reloading configuration")
+			s.reload()
 		}
 	}()
 
-	types := make([]string, 0, len(configuration.groupIds))
-	for _, key := range configuration.groupIds {
-		types = append(types, key)
-	}
-	log.Println("Types:", types)
-	projTypes = &tdrTypes{
-		Names: types,
-	}
-
-	r := s.newRouter(configuration.apiToken, configuration.frontendOrigin)
+	r := s.newRouter()
+	requestTimeout := time.Duration(configuration.requestTimeoutSeconds) * time.Second
 
 	srv := &http.Server{
-		Addr: s.configuration.address,
+		Addr: configuration.address,
 		// Good practice to set timeouts to avoid Slowloris attacks.
-		WriteTimeout: time.Second * 15,
+		// The write timeout leaves some time to respond after the request
+		// deadline has passed, so that slow GitLab calls end in a 504
+		// instead of a closed connection.
+		WriteTimeout: requestTimeout + 5*time.Second,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
-		Handler:      r, // Pass our instance of gorilla/mux in.
+		Handler:      s.withRequestLogging(withRequestTimeout(withCORS(r, s.cors), requestTimeout)), // Pass our instance of gorilla/mux in.
 	}
 
 	// Run our server in a goroutine so that it doesn't block.
-	log.Println("Starting web server on", configuration.address)
+	logger.WithField("address", configuration.address).Info("Starting web server")
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Print(err)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.WithError(err).Error("Web server stopped")
 		}
 	}()
 
+	// GitLab might be unavailable or hang, in which case the server runs in
+	// degraded mode and keeps trying in the background
+	go s.resolveDependencies()
+	go s.runRefresher(time.Duration(configuration.updateIntervalSeconds) * time.Second)
+	go s.runBreakerProbe()
+	go s.runTagWatcher()
+	go s.runGitLabProbe()
+
 	c := make(chan os.Signal, 1)
-	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, os.Interrupt)
+	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C) or
+	// SIGTERM, which is what OpenShift sends when stopping a pod.
+	// SIGKILL or SIGQUIT (Ctrl+/) will not be caught.
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	// Block until we receive our signal.
-	<-c
+	sig := <-c
 
-	log.Println("Stopping...")
+	logger.WithField("signal", sig.String()).Info("Stopping...")
+	s.shutdown(srv, time.Duration(s.config().shutdownDelaySeconds)*time.Second, time.Duration(s.config().shutdownTimeoutSeconds)*time.Second)
+	logger.Info("Stopped")
 
 	// TODO: implement callback from GitLab for status update
 	// TODO: Get only commits of last N days
 	// TODO: Improve error messages returned
-	// TODO: Implement better logging making use of DEBUG flag
 
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xanzy/go-gitlab"
+)
+
+// shareSigner issues and verifies links that give access to the status and
+// artifact of a single pipeline without the API token.
+type shareSigner struct {
+	secret []byte
+	maxTTL time.Duration
+}
+
+func newShareSigner(secret string, maxTTL time.Duration) *shareSigner {
+	if secret == "" {
+		return nil
+	}
+	return &shareSigner{
+		secret: []byte(secret),
+		maxTTL: maxTTL,
+	}
+}
+
+func (ss *shareSigner) signature(pipelineID int, expires int64, scope string) string {
+	mac := hmac.New(sha256.New, ss.secret)
+	fmt.Fprintf(mac, "%d\n%d\n%s", pipelineID, expires, scope)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// query returns the query string to append to the shared routes.
+func (ss *shareSigner) query(pipelineID int, expires time.Time, scope string) string {
+	values := url.Values{}
+	values.Set("exp", strconv.FormatInt(expires.Unix(), 10))
+	if scope != "" {
+		values.Set("scope", scope)
+	}
+	values.Set("sig", ss.signature(pipelineID, expires.Unix(), scope))
+	return values.Encode()
+}
+
+// verify checks the signature of a shared link and returns its scope.
+func (ss *shareSigner) verify(pipelineID int, values url.Values) (string, error) {
+	expires, err := strconv.ParseInt(values.Get("exp"), 10, 64)
+	if err != nil {
+		return "", errors.New("invalid link")
+	}
+	scope := values.Get("scope")
+	expected := ss.signature(pipelineID, expires, scope)
+	if !hmac.Equal([]byte(values.Get("sig")), []byte(expected)) {
+		return "", errors.New("invalid link")
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return "", errors.New("link expired")
+	}
+	return scope, nil
+}
+
+type shareStruct struct {
+	PipelineID       int    `json:"pipeline_id"`
+	Group            string `json:"group"`
+	Project          string `json:"project"`
+	ExpiresInSeconds int    `json:"expires_in_seconds"`
+}
+
+func (s *server) handleShare() http.HandlerFunc {
+	type response struct {
+		StatusURL   string    `json:"status_url"`
+		ArtifactURL string    `json:"artifact_url"`
+		ExpiresAt   time.Time `json:"expires_at"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		shareSigner := s.shareLinks()
+		if shareSigner == nil {
+			respondErr(w, r, http.StatusServiceUnavailable, "share links are not configured")
+			return
+		}
+		var shareObject shareStruct
+		if err := decodeBody(r, &shareObject); err != nil {
+			respondErr(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if shareObject.PipelineID <= 0 {
+			respondErr(w, r, http.StatusBadRequest, "pipeline_id is required")
+			return
+		}
+		if (shareObject.Group == "") != (shareObject.Project == "") {
+			respondErr(w, r, http.StatusBadRequest, "group and project must be given together")
+			return
+		}
+		ttl := time.Duration(shareObject.ExpiresInSeconds) * time.Second
+		if ttl <= 0 || ttl > shareSigner.maxTTL {
+			ttl = shareSigner.maxTTL
+		}
+		scope := ""
+		if shareObject.Group != "" {
+			scope = shareObject.Group + "/" + shareObject.Project
+		}
+		auditParams := map[string]string{
+			"pipeline_id": strconv.Itoa(shareObject.PipelineID),
+			"scope":       scope,
+			"ttl":         ttl.String(),
+		}
+		if scope != "" {
+			if err := s.checkShareScope(r.Context(), shareObject.PipelineID, scope); err != nil {
+				s.audit(r, "share", auditParams, err)
+				respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+				return
+			}
+		}
+		s.audit(r, "share", auditParams, nil)
+
+		expires := time.Now().Add(ttl).Truncate(time.Second)
+		query := shareSigner.query(shareObject.PipelineID, expires, scope)
+		prefix := "/shared/pipeline/" + strconv.Itoa(shareObject.PipelineID)
+		shareResponse := response{
+			StatusURL:   prefix + "/status?" + query,
+			ArtifactURL: prefix + "/artifact?" + query,
+			ExpiresAt:   expires.UTC(),
+		}
+		respond(w, r, http.StatusOK, shareResponse)
+	}
+}
+
+// checkShareScope makes sure that the pipeline diffs the project the link is
+// scoped to.
+func (s *server) checkShareScope(ctx context.Context, pipelineID int, scope string) error {
+	variables, err := s.getPipelineVariables(ctx, pipelineID)
+	if err != nil {
+		return err
+	}
+	if variables["REPO_GROUP"]+"/"+variables["REPO_PROJECT"] != scope {
+		return errors.New("pipeline does not belong to " + scope)
+	}
+	return nil
+}
+
+// withShareLink authenticates requests to the shared routes with the signed
+// query parameters instead of the API token.
+func (s *server) withShareLink(fn func(http.ResponseWriter, *http.Request, *gitlab.Job)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		shareSigner := s.shareLinks()
+		if shareSigner == nil {
+			respondHTTPErr(w, r, http.StatusNotFound)
+			return
+		}
+		pipelineID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondErr(w, r, http.StatusBadRequest, err)
+			return
+		}
+		scope, err := shareSigner.verify(pipelineID, r.URL.Query())
+		if err != nil {
+			respondErr(w, r, http.StatusForbidden, err)
+			return
+		}
+		if scope != "" {
+			if err := s.checkShareScope(r.Context(), pipelineID, scope); err != nil {
+				respondErr(w, r, gitlabErrStatus(err, http.StatusForbidden), err)
+				return
+			}
+		}
+		setRequestIdentity(r.Context(), "share:"+strconv.Itoa(pipelineID))
+		job, err := s.getPipelineJob(r.Context(), pipelineID)
+		if err != nil {
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		fn(w, r, job)
+	}
+}
+
+// sharedJobStatus is the part of the diff job shown to holders of a share
+// link. The full job would reveal who triggered it and runner details.
+type sharedJobStatus struct {
+	Status            string     `json:"status"`
+	CreatedAt         *time.Time `json:"created_at"`
+	StartedAt         *time.Time `json:"started_at"`
+	FinishedAt        *time.Time `json:"finished_at"`
+	ArtifactAvailable bool       `json:"artifact_available"`
+}
+
+func (s *server) handleSharedStatus() http.HandlerFunc {
+	type response struct {
+		JobStatus sharedJobStatus `json:"job_status"`
+	}
+	return s.withShareLink(func(w http.ResponseWriter, r *http.Request, job *gitlab.Job) {
+		jobStatus := sharedJobStatus{
+			Status:            job.Status,
+			CreatedAt:         job.CreatedAt,
+			StartedAt:         job.StartedAt,
+			FinishedAt:        job.FinishedAt,
+			ArtifactAvailable: job.Status == "success",
+		}
+		respond(w, r, http.StatusOK, response{JobStatus: jobStatus})
+	})
+}
+
+func (s *server) handleSharedArtifact() http.HandlerFunc {
+	return s.withShareLink(func(w http.ResponseWriter, r *http.Request, job *gitlab.Job) {
+		if job.Status != "success" {
+			respondErr(w, r, http.StatusConflict, "diff is not available, job status is ", job.Status)
+			return
+		}
+		withContext, done := s.gitlabRequest(r.Context(), "DownloadSingleArtifactsFile")
+		artifact, _, err := s.gl.Jobs.DownloadSingleArtifactsFile(getPipelineProjectID(), job.ID, s.config().diffArtifactPath, withContext)
+		err = done(err)
+		if err != nil {
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadGateway), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", "inline; filename=\"diff.pdf\"")
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, artifact)
+	})
+}
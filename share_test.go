@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShareSignerVerify(t *testing.T) {
+	signer := newShareSigner("secret", time.Hour)
+	expires := time.Now().Add(time.Hour)
+	link := func(scope string) url.Values {
+		values, err := url.ParseQuery(signer.query(42, expires, scope))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return values
+	}
+	tests := []struct {
+		name       string
+		pipelineID int
+		values     func() url.Values
+		scope      string
+		wantErr    bool
+	}{
+		{
+			name:       "valid link",
+			pipelineID: 42,
+			values:     func() url.Values { return link("") },
+		},
+		{
+			name:       "valid link with scope",
+			pipelineID: 42,
+			values:     func() url.Values { return link("CMS/EXO-20-001") },
+			scope:      "CMS/EXO-20-001",
+		},
+		{
+			name:       "other pipeline",
+			pipelineID: 43,
+			values:     func() url.Values { return link("") },
+			wantErr:    true,
+		},
+		{
+			name:       "tampered exp",
+			pipelineID: 42,
+			values: func() url.Values {
+				values := link("")
+				values.Set("exp", strconv.FormatInt(expires.Add(time.Hour).Unix(), 10))
+				return values
+			},
+			wantErr: true,
+		},
+		{
+			name:       "tampered scope",
+			pipelineID: 42,
+			values: func() url.Values {
+				values := link("CMS/EXO-20-001")
+				values.Set("scope", "CMS/EXO-20-002")
+				return values
+			},
+			wantErr: true,
+		},
+		{
+			name:       "scope removed",
+			pipelineID: 42,
+			values: func() url.Values {
+				values := link("CMS/EXO-20-001")
+				values.Del("scope")
+				return values
+			},
+			wantErr: true,
+		},
+		{
+			name:       "tampered signature",
+			pipelineID: 42,
+			values: func() url.Values {
+				values := link("")
+				values.Set("sig", values.Get("sig")[1:])
+				return values
+			},
+			wantErr: true,
+		},
+		{
+			name:       "signed with another secret",
+			pipelineID: 42,
+			values: func() url.Values {
+				values, _ := url.ParseQuery(newShareSigner("other", time.Hour).query(42, expires, ""))
+				return values
+			},
+			wantErr: true,
+		},
+		{
+			name:       "invalid exp",
+			pipelineID: 42,
+			values: func() url.Values {
+				values := link("")
+				values.Set("exp", "tomorrow")
+				return values
+			},
+			wantErr: true,
+		},
+		{
+			name:       "expired link",
+			pipelineID: 42,
+			values: func() url.Values {
+				values, _ := url.ParseQuery(signer.query(42, time.Now().Add(-time.Second), ""))
+				return values
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scope, err := signer.verify(test.pipelineID, test.values())
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("link accepted with scope %q", scope)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if scope != test.scope {
+				t.Errorf("got scope %q, want %q", scope, test.scope)
+			}
+		})
+	}
+}
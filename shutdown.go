@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// shuttingDown reports whether the server is draining requests before it
+// stops.
+func (s *server) shuttingDown() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown reports not ready and keeps serving for delay, so that the
+// endpoints are updated before the listener closes. It then stops accepting
+// new connections and waits up to timeout for in-flight requests, e.g.
+// triggers, to finish. Afterwards the refresher and the tag watcher are
+// stopped, so that automatic diffs in flight are still recorded, the history
+// is saved and the audit log is flushed and closed.
+func (s *server) shutdown(srv *http.Server, delay time.Duration, timeout time.Duration) {
+	close(s.stopping)
+	logger.WithField("delay", delay).Info("Reporting not ready before draining")
+	time.Sleep(delay)
+	logger.WithField("timeout", timeout).Info("Draining requests")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.WithError(err).Error("Draining requests failed")
+	}
+
+	select {
+	case <-s.refresherDone:
+	case <-ctx.Done():
+		logger.Warn("Refresh still running, not waiting for it")
+	}
+	select {
+	case <-s.tagWatcherDone:
+	case <-ctx.Done():
+		logger.Warn("Tag check still running, not waiting for it")
+	}
+
+	if err := s.history.close(); err != nil {
+		logger.WithError(err).Error("Saving history failed")
+	}
+	if err := s.auditLog.close(); err != nil {
+		logger.WithError(err).Error("Closing audit log failed")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// diffSuggestion is a pair of commits that is commonly diffed. SHA1 is the
+// older commit.
+type diffSuggestion struct {
+	Kind        string `json:"kind"`
+	Description string `json:"description"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	SHA1        string `json:"sha1"`
+	SHA2        string `json:"sha2"`
+	// set if the diff has been triggered before
+	Exists     bool   `json:"exists"`
+	PipelineID int    `json:"pipeline_id,omitempty"`
+	Status     string `json:"status,omitempty"`
+}
+
+// suggestDiffs returns the latest version against the one before and the
+// head of the default branch against the latest version.
+func suggestDiffs(commits []gitlabCommitList, versions []tagVersion, patterns []string) []diffSuggestion {
+	suggestions := []diffSuggestion{}
+	var latest *tagVersion
+	for i := len(versions) - 1; i >= 0; i-- {
+		if tagMatches(versions[i].Name, patterns) {
+			latest = &versions[i]
+			break
+		}
+	}
+	if latest == nil {
+		return suggestions
+	}
+	if latest.PreviousCommitID != "" && latest.PreviousCommitID != latest.CommitID {
+		suggestions = append(suggestions, diffSuggestion{
+			Kind:        "previous_version",
+			Description: "Latest version against the version before",
+			From:        latest.Previous,
+			To:          latest.Name,
+			SHA1:        latest.PreviousCommitID,
+			SHA2:        latest.CommitID,
+		})
+	}
+	if len(commits) > 0 && commits[0].ID != latest.CommitID {
+		suggestions = append(suggestions, diffSuggestion{
+			Kind:        "head",
+			Description: "Latest commit against the latest version",
+			From:        latest.Name,
+			To:          "HEAD",
+			SHA1:        latest.CommitID,
+			SHA2:        commits[0].ID,
+		})
+	}
+	return suggestions
+}
+
+// annotateSuggestions looks up whether the suggested diffs exist already and
+// what the status of their pipelines is.
+func (s *server) annotateSuggestions(ctx context.Context, group, project string, suggestions []diffSuggestion) {
+	for i, suggestion := range suggestions {
+		entry, ok := s.history.find(group, project, suggestion.SHA1, suggestion.SHA2)
+		if !ok {
+			continue
+		}
+		suggestions[i].Exists = true
+		suggestions[i].PipelineID = entry.PipelineID
+		suggestions[i].Status = "unknown"
+		if getPipelineProjectID() == 0 {
+			continue
+		}
+		if job, err := s.getPipelineJob(ctx, entry.PipelineID); err == nil {
+			suggestions[i].Status = job.Status
+		}
+	}
+}
+
+func (s *server) handleSuggest() http.HandlerFunc {
+	type response struct {
+		ProjectInfo gitlabProjectList `json:"project_info"`
+		Suggestions []diffSuggestion  `json:"suggestions"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		projectGroup := vars["group"]
+		projectID := vars["id"]
+		requestLogger(r).WithFields(logrus.Fields{"group": projectGroup, "project": projectID}).Debug("Suggesting diffs")
+		projectInfo, err := s.getProjectInfo(r.Context(), projectGroup, projectID)
+		if err != nil {
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		commitList, err := s.getCommits(r.Context(), projectInfo.ID, "")
+		if err != nil {
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		tagList, err := s.getTags(r.Context(), projectInfo.ID)
+		if err != nil {
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		patterns := s.config().tagPatterns
+		suggestions := suggestDiffs(commitList, versionTimeline(tagList, patterns), patterns)
+		s.annotateSuggestions(r.Context(), projectGroup, projectID, suggestions)
+		suggestResponse := response{
+			ProjectInfo: projectInfo,
+			Suggestions: suggestions,
+		}
+		respond(w, r, http.StatusOK, suggestResponse)
+	}
+}
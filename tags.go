@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// CADI build tags look like CADI-BuildTag-17 or CADI-BuildTag_2020-04-15_3
+	buildTagDate   = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})`)
+	buildTagNumber = regexp.MustCompile(`(\d+)\D*$`)
+)
+
+// tagVersion is a tag in the version timeline of a project.
+type tagVersion struct {
+	gitlabTag
+	ShortID string `json:"short_id"`
+	// Build and BuildDate are parsed from the names of tags matching
+	// tagPatterns, if they contain them
+	Build     int        `json:"build,omitempty"`
+	BuildDate *time.Time `json:"build_date,omitempty"`
+	// the previous version, to offer a diff against it
+	Previous             string `json:"previous,omitempty"`
+	PreviousCommitID     string `json:"previous_commit_id,omitempty"`
+	SecondsSincePrevious int64  `json:"seconds_since_previous,omitempty"`
+}
+
+// parseBuildTag extracts the build date and number from the name of a CADI
+// build tag. Either may be missing.
+func parseBuildTag(name string) (int, *time.Time) {
+	var buildDate *time.Time
+	rest := name
+	if match := buildTagDate.FindStringSubmatchIndex(name); match != nil {
+		date, err := time.Parse("20060102", name[match[2]:match[3]]+name[match[4]:match[5]]+name[match[6]:match[7]])
+		if err == nil {
+			buildDate = &date
+			rest = name[match[1]:]
+		}
+	}
+	build := 0
+	if match := buildTagNumber.FindStringSubmatch(rest); match != nil {
+		build, _ = strconv.Atoi(match[1])
+	}
+	return build, buildDate
+}
+
+// versionTimeline sorts the tags by date and links every version to the one
+// before. Only tags matching the patterns count as versions, the others are
+// included without a previous version.
+func versionTimeline(tags []gitlabTag, patterns []string) []tagVersion {
+	versions := make([]tagVersion, len(tags))
+	for i, tag := range tags {
+		versions[i] = tagVersion{gitlabTag: tag}
+		if len(tag.CommitID) >= 8 {
+			versions[i].ShortID = tag.CommitID[:8]
+		}
+		if tagMatches(tag.Name, patterns) {
+			versions[i].Build, versions[i].BuildDate = parseBuildTag(tag.Name)
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		if a.Date != nil && b.Date != nil && !a.Date.Equal(*b.Date) {
+			return a.Date.Before(*b.Date)
+		}
+		if (a.Date == nil) != (b.Date == nil) {
+			return a.Date == nil
+		}
+		return a.Build < b.Build
+	})
+	var previous *tagVersion
+	for i := range versions {
+		if !tagMatches(versions[i].Name, patterns) {
+			continue
+		}
+		if previous != nil {
+			versions[i].Previous = previous.Name
+			versions[i].PreviousCommitID = previous.CommitID
+			if versions[i].Date != nil && previous.Date != nil {
+				versions[i].SecondsSincePrevious = int64(versions[i].Date.Sub(*previous.Date).Seconds())
+			}
+		}
+		previous = &versions[i]
+	}
+	return versions
+}
+
+func (s *server) handleTags() http.HandlerFunc {
+	type response struct {
+		ProjectInfo gitlabProjectList `json:"project_info"`
+		Tags        []tagVersion      `json:"tags"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		projectGroup := vars["group"]
+		projectID := vars["id"]
+		requestLogger(r).WithFields(logrus.Fields{"group": projectGroup, "project": projectID}).Debug("Listing tags")
+		projectInfo, err := s.getProjectInfo(r.Context(), projectGroup, projectID)
+		if err != nil {
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		tagList, err := s.getTags(r.Context(), projectInfo.ID)
+		if err != nil {
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		tagsResponse := response{
+			ProjectInfo: projectInfo,
+			Tags:        versionTimeline(tagList, s.config().tagPatterns),
+		}
+		respond(w, r, http.StatusOK, tagsResponse)
+	}
+}
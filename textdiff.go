@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// textDiffMaxEdits limits the number of changed tokens, which bounds the time
+// spent on the diff.
+const textDiffMaxEdits = 20000
+
+var errTooManyChanges = errors.New("the versions differ too much for a word diff")
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenSpace
+	tokenCommand     // \section, \% or \\
+	tokenEnvironment // \begin{figure} or \end{figure}
+	tokenComment     // from % to the end of the line
+	tokenSymbol      // braces, math shifts and punctuation
+)
+
+type latexToken struct {
+	text string
+	kind tokenKind
+}
+
+// key is what is compared. LaTeX treats a single line break like a space, so
+// whitespace only counts as a space or a paragraph break.
+func (t latexToken) key() string {
+	if t.kind != tokenSpace {
+		return t.text
+	}
+	if strings.Count(t.text, "\n") > 1 {
+		return "\n\n"
+	}
+	return " "
+}
+
+func isLetter(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+// tokenizeLaTeX splits LaTeX source into words, whitespace, commands,
+// environment delimiters, comments and symbols. Joining the tokens gives the
+// source back.
+func tokenizeLaTeX(source string) []latexToken {
+	var tokens []latexToken
+	for i := 0; i < len(source); {
+		r, size := utf8.DecodeRuneInString(source[i:])
+		start := i
+		kind := tokenSymbol
+		switch {
+		case r == '%':
+			kind = tokenComment
+			if end := strings.IndexByte(source[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(source)
+			}
+		case r == '\\':
+			kind = tokenCommand
+			i++
+			if i < len(source) && !isLetter(rune(source[i])) {
+				// control symbol like \% or \\
+				_, size = utf8.DecodeRuneInString(source[i:])
+				i += size
+				break
+			}
+			for i < len(source) && isLetter(rune(source[i])) {
+				i++
+			}
+			if i < len(source) && source[i] == '*' {
+				i++
+			}
+			name := source[start:i]
+			if (name == `\begin` || name == `\end`) && strings.HasPrefix(source[i:], "{") {
+				if end := strings.IndexByte(source[i:], '}'); end > 0 && !strings.ContainsAny(source[i:i+end], "\n\\") {
+					kind = tokenEnvironment
+					i += end + 1
+				}
+			}
+		case unicode.IsSpace(r):
+			kind = tokenSpace
+			for i < len(source) {
+				r, size = utf8.DecodeRuneInString(source[i:])
+				if !unicode.IsSpace(r) {
+					break
+				}
+				i += size
+			}
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			kind = tokenWord
+			for i < len(source) {
+				r, size = utf8.DecodeRuneInString(source[i:])
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += size
+			}
+		default:
+			i += size
+		}
+		tokens = append(tokens, latexToken{text: source[start:i], kind: kind})
+	}
+	return tokens
+}
+
+type editKind byte
+
+const (
+	editEqual editKind = iota
+	editDelete
+	editInsert
+)
+
+// diffSequences returns the shortest edit script turning a into b, one edit
+// per element, using the linear space variant of Myers' algorithm. It stops
+// with the error of ctx once ctx is done.
+func diffSequences(ctx context.Context, a, b []int, maxEdits int) ([]editKind, error) {
+	var edits []editKind
+	// common prefix and suffix are cheap and usually most of a document
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, editEqual)
+	}
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(a) > 0 && len(b) > 0 {
+		if d, _, _, _, _ := middleSnake(ctx, a, b, (maxEdits+1)/2); d < 0 || d > maxEdits {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, errTooManyChanges
+		}
+	}
+	edits = diffRecursive(ctx, a, b, edits)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	for i := 0; i < suffix; i++ {
+		edits = append(edits, editEqual)
+	}
+	return edits, nil
+}
+
+// diffRecursive appends the edits turning a into b. The edits are incomplete
+// if ctx is done.
+func diffRecursive(ctx context.Context, a, b []int, edits []editKind) []editKind {
+	n, m := len(a), len(b)
+	switch {
+	case n == 0:
+		for j := 0; j < m; j++ {
+			edits = append(edits, editInsert)
+		}
+		return edits
+	case m == 0:
+		for i := 0; i < n; i++ {
+			edits = append(edits, editDelete)
+		}
+		return edits
+	}
+	d, x, y, u, v := middleSnake(ctx, a, b, (n+m+1)/2)
+	if d < 0 {
+		return edits
+	}
+	if d > 1 {
+		edits = diffRecursive(ctx, a[:x], b[:y], edits)
+		for i := x; i < u; i++ {
+			edits = append(edits, editEqual)
+		}
+		return diffRecursive(ctx, a[u:], b[v:], edits)
+	}
+	// at most one element inserted or deleted
+	i, j := 0, 0
+	for i < n && j < m && a[i] == b[j] {
+		edits = append(edits, editEqual)
+		i++
+		j++
+	}
+	if n > m {
+		edits = append(edits, editDelete)
+		i++
+	} else if m > n {
+		edits = append(edits, editInsert)
+		j++
+	}
+	for ; i < n; i++ {
+		edits = append(edits, editEqual)
+	}
+	return edits
+}
+
+// middleSnake finds the middle snake from (x, y) to (u, v) of an edit
+// script with d edits. It gives up with d = -1 once more than 2*maxD edits
+// would be needed or ctx is done.
+func middleSnake(ctx context.Context, a, b []int, maxD int) (d, x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	offset := maxD + 1
+	forward := make([]int, 2*maxD+3)
+	backward := make([]int, 2*maxD+3)
+	for d := 0; d <= maxD; d++ {
+		if ctx.Err() != nil {
+			break
+		}
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y = x - k
+			startX, startY := x, y
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			if c := delta - k; odd && c >= -(d-1) && c <= d-1 && x+backward[offset+c] >= n {
+				return 2*d - 1, startX, startY, x, y
+			}
+		}
+		for c := -d; c <= d; c += 2 {
+			if c == -d || (c != d && backward[offset+c-1] < backward[offset+c+1]) {
+				x = backward[offset+c+1]
+			} else {
+				x = backward[offset+c-1] + 1
+			}
+			y = x - c
+			startX, startY := x, y
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[offset+c] = x
+			if k := delta - c; !odd && k >= -d && k <= d && x+forward[offset+k] >= n {
+				return 2 * d, n - x, m - y, n - startX, m - startY
+			}
+		}
+	}
+	return -1, 0, 0, 0, 0
+}
+
+// textHunk is a part of the file that is equal in both versions or changed.
+// Lines start at 1.
+type textHunk struct {
+	Type    string `json:"type"` // equal, insert, delete or replace
+	Old     string `json:"old"`
+	New     string `json:"new"`
+	OldLine int    `json:"old_line"`
+	NewLine int    `json:"new_line"`
+	// only comments changed, which does not change the document
+	CommentOnly bool `json:"comment_only,omitempty"`
+}
+
+// wordDiff compares two versions of a LaTeX file token by token. Spaces
+// between two changes are included in the change, so that rewritten
+// sentences form one hunk.
+func wordDiff(ctx context.Context, oldSource, newSource string) ([]textHunk, error) {
+	oldTokens := tokenizeLaTeX(oldSource)
+	newTokens := tokenizeLaTeX(newSource)
+	ids := make(map[string]int)
+	intern := func(tokens []latexToken) []int {
+		keys := make([]int, len(tokens))
+		for i, token := range tokens {
+			id, ok := ids[token.key()]
+			if !ok {
+				id = len(ids)
+				ids[token.key()] = id
+			}
+			keys[i] = id
+		}
+		return keys
+	}
+	edits, err := diffSequences(ctx, intern(oldTokens), intern(newTokens), textDiffMaxEdits)
+	if err != nil {
+		return nil, err
+	}
+
+	// group the edits into runs of equal and changed tokens
+	type run struct {
+		changed        bool
+		oldFrom, oldTo int
+		newFrom, newTo int
+		onlySpaces     bool
+	}
+	var runs []run
+	i, j := 0, 0
+	for _, edit := range edits {
+		changed := edit != editEqual
+		if len(runs) == 0 || runs[len(runs)-1].changed != changed {
+			runs = append(runs, run{changed: changed, oldFrom: i, oldTo: i, newFrom: j, newTo: j, onlySpaces: true})
+		}
+		current := &runs[len(runs)-1]
+		if edit != editInsert {
+			current.onlySpaces = current.onlySpaces && oldTokens[i].kind == tokenSpace
+			i++
+			current.oldTo = i
+		}
+		if edit != editDelete {
+			j++
+			current.newTo = j
+		}
+	}
+	// merge changes separated by nothing but a space
+	merged := runs[:0]
+	for n, current := range runs {
+		last := len(merged) - 1
+		between := !current.changed && current.onlySpaces && n > 0 && n < len(runs)-1
+		if last >= 0 && merged[last].changed && (current.changed || between) {
+			merged[last].oldTo, merged[last].newTo = current.oldTo, current.newTo
+			continue
+		}
+		merged = append(merged, current)
+	}
+
+	join := func(tokens []latexToken) string {
+		var text strings.Builder
+		for _, token := range tokens {
+			text.WriteString(token.text)
+		}
+		return text.String()
+	}
+	onlyComments := func(tokens []latexToken) bool {
+		for _, token := range tokens {
+			if token.kind != tokenComment && token.kind != tokenSpace {
+				return false
+			}
+		}
+		return true
+	}
+	hunks := make([]textHunk, 0, len(merged))
+	oldLine, newLine := 1, 1
+	for _, current := range merged {
+		oldPart := oldTokens[current.oldFrom:current.oldTo]
+		newPart := newTokens[current.newFrom:current.newTo]
+		hunk := textHunk{
+			Type:    "equal",
+			Old:     join(oldPart),
+			New:     join(newPart),
+			OldLine: oldLine,
+			NewLine: newLine,
+		}
+		if current.changed {
+			switch {
+			case len(oldPart) == 0:
+				hunk.Type = "insert"
+			case len(newPart) == 0:
+				hunk.Type = "delete"
+			default:
+				hunk.Type = "replace"
+			}
+			hunk.CommentOnly = onlyComments(oldPart) && onlyComments(newPart)
+		}
+		oldLine += strings.Count(hunk.Old, "\n")
+		newLine += strings.Count(hunk.New, "\n")
+		hunks = append(hunks, hunk)
+	}
+	return hunks, nil
+}
+
+func isGitLabNotFound(err error) bool {
+	var errResponse *gitlab.ErrorResponse
+	return errors.As(err, &errResponse) && errResponse.Response != nil && errResponse.Response.StatusCode == http.StatusNotFound
+}
+
+func (s *server) handleTextDiff() http.HandlerFunc {
+	type response struct {
+		ProjectInfo gitlabProjectList `json:"project_info"`
+		From        string            `json:"from"`
+		To          string            `json:"to"`
+		Path        string            `json:"path"`
+		Hunks       []textHunk        `json:"hunks"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		projectGroup := vars["group"]
+		projectID := vars["id"]
+		query := r.URL.Query()
+		from, to, filePath := query.Get("from"), query.Get("to"), query.Get("path")
+		if from == "" || to == "" || filePath == "" {
+			respondErr(w, r, http.StatusBadRequest, "from, to and path are required")
+			return
+		}
+		if fileKind(filePath) != "tex" {
+			respondErr(w, r, http.StatusBadRequest, "only .tex files can be compared")
+			return
+		}
+		requestLogger(r).WithFields(logrus.Fields{"group": projectGroup, "project": projectID, "from": from, "to": to, "path": filePath}).Debug("Comparing file")
+		projectInfo, err := s.getProjectInfo(r.Context(), projectGroup, projectID)
+		if err != nil {
+			respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		// a file missing in one of the versions has been added or deleted
+		versions := make([]string, 2)
+		missing := 0
+		maxBytes := s.config().textDiffMaxBytes
+		for n, ref := range []string{from, to} {
+			content, err := s.getRawFile(r.Context(), projectInfo.ID, filePath, ref, maxBytes)
+			if isGitLabNotFound(err) {
+				missing++
+				continue
+			}
+			if err == errFileTooLarge {
+				respondErr(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("%s is larger than %d bytes at %s", filePath, maxBytes, ref))
+				return
+			}
+			if err != nil {
+				respondErr(w, r, gitlabErrStatus(err, http.StatusBadRequest), err)
+				return
+			}
+			versions[n] = string(content)
+		}
+		if missing == 2 {
+			respondErr(w, r, http.StatusNotFound, filePath, " not found")
+			return
+		}
+		hunks, err := wordDiff(r.Context(), versions[0], versions[1])
+		switch {
+		case err == context.DeadlineExceeded:
+			respondErr(w, r, http.StatusGatewayTimeout, "comparing ", filePath, " took too long")
+			return
+		case err != nil:
+			respondErr(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		textDiffResponse := response{
+			ProjectInfo: projectInfo,
+			From:        from,
+			To:          to,
+			Path:        filePath,
+			Hunks:       hunks,
+		}
+		respond(w, r, http.StatusOK, textDiffResponse)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenizeLaTeX(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		texts  []string
+		kinds  []tokenKind
+	}{
+		{
+			name:   "words and spaces",
+			source: "The quick\n fox",
+			texts:  []string{"The", " ", "quick", "\n ", "fox"},
+			kinds:  []tokenKind{tokenWord, tokenSpace, tokenWord, tokenSpace, tokenWord},
+		},
+		{
+			name:   "commands and symbols",
+			source: `\section*{Intro} 50\% \\`,
+			texts:  []string{`\section*`, "{", "Intro", "}", " ", "50", `\%`, " ", `\\`},
+			kinds:  []tokenKind{tokenCommand, tokenSymbol, tokenWord, tokenSymbol, tokenSpace, tokenWord, tokenCommand, tokenSpace, tokenCommand},
+		},
+		{
+			name:   "environments",
+			source: `\begin{figure}\end{figure}\begin{`,
+			texts:  []string{`\begin{figure}`, `\end{figure}`, `\begin`, "{"},
+			kinds:  []tokenKind{tokenEnvironment, tokenEnvironment, tokenCommand, tokenSymbol},
+		},
+		{
+			name:   "comments",
+			source: "a % note\n% last",
+			texts:  []string{"a", " ", "% note", "\n", "% last"},
+			kinds:  []tokenKind{tokenWord, tokenSpace, tokenComment, tokenSpace, tokenComment},
+		},
+		{
+			name:   "unicode",
+			source: "Größe $x$",
+			texts:  []string{"Größe", " ", "$", "x", "$"},
+			kinds:  []tokenKind{tokenWord, tokenSpace, tokenSymbol, tokenWord, tokenSymbol},
+		},
+		{
+			name:   "trailing backslash",
+			source: `a\`,
+			texts:  []string{"a", `\`},
+			kinds:  []tokenKind{tokenWord, tokenCommand},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokens := tokenizeLaTeX(test.source)
+			texts := make([]string, len(tokens))
+			kinds := make([]tokenKind, len(tokens))
+			for i, token := range tokens {
+				texts[i] = token.text
+				kinds[i] = token.kind
+			}
+			if strings.Join(texts, "") != test.source {
+				t.Errorf("tokens do not join to the source: %q", texts)
+			}
+			if !reflect.DeepEqual(texts, test.texts) {
+				t.Errorf("got tokens %q, want %q", texts, test.texts)
+			}
+			if !reflect.DeepEqual(kinds, test.kinds) {
+				t.Errorf("got kinds %v, want %v", kinds, test.kinds)
+			}
+		})
+	}
+}
+
+func TestTokenizeLaTeXManyComments(t *testing.T) {
+	source := strings.Repeat("% a comment line\n", 1<<16)
+	start := time.Now()
+	tokens := tokenizeLaTeX(source)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("tokenizing took %s", elapsed)
+	}
+	if len(tokens) != 2<<16 {
+		t.Errorf("got %d tokens, want %d", len(tokens), 2<<16)
+	}
+}
+
+// editDistance is the number of insertions and deletions of the shortest
+// edit script, computed via the longest common subsequence.
+func editDistance(a, b []int) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] > lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return len(a) + len(b) - 2*lcs[0][0]
+}
+
+func TestDiffSequences(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []int
+	}{
+		{"empty", nil, nil},
+		{"insert all", nil, []int{1, 2, 3}},
+		{"delete all", []int{1, 2, 3}, nil},
+		{"equal", []int{1, 2, 3}, []int{1, 2, 3}},
+		{"replace middle", []int{1, 2, 3}, []int{1, 4, 3}},
+		{"disjoint", []int{1, 2, 3}, []int{4, 5}},
+		{"myers example", []int{1, 2, 3, 1, 2, 2, 1}, []int{3, 2, 1, 2, 1, 3}},
+		{"repeated", []int{1, 1, 1, 2, 1, 1}, []int{1, 2, 1, 1, 1, 1, 2}},
+		{"odd delta", []int{1, 2, 3, 4, 5}, []int{2, 4}},
+		{"even delta", []int{5, 1, 2, 3}, []int{1, 3, 4, 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			edits, err := diffSequences(context.Background(), test.a, test.b, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			i, j, changes := 0, 0, 0
+			for _, edit := range edits {
+				switch edit {
+				case editEqual:
+					if i >= len(test.a) || j >= len(test.b) || test.a[i] != test.b[j] {
+						t.Fatalf("edit script %v keeps unequal elements", edits)
+					}
+					i++
+					j++
+				case editDelete:
+					i++
+					changes++
+				case editInsert:
+					j++
+					changes++
+				}
+			}
+			if i != len(test.a) || j != len(test.b) {
+				t.Fatalf("edit script %v does not cover both sequences", edits)
+			}
+			if want := editDistance(test.a, test.b); changes != want {
+				t.Errorf("got %d changes, want %d", changes, want)
+			}
+		})
+	}
+}
+
+func TestDiffSequencesLimits(t *testing.T) {
+	a := make([]int, 1000)
+	b := make([]int, 1000)
+	for i := range a {
+		a[i] = i
+		b[i] = -i - 1
+	}
+	if _, err := diffSequences(context.Background(), a, b, 100); err != errTooManyChanges {
+		t.Errorf("got %v, want errTooManyChanges", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := diffSequences(ctx, a, b, 10000); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestWordDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		hunks    []textHunk
+	}{
+		{
+			name: "replaced words form one hunk",
+			old:  "The quick brown fox.",
+			new:  "The slow red fox.",
+			hunks: []textHunk{
+				{Type: "equal", Old: "The ", New: "The ", OldLine: 1, NewLine: 1},
+				{Type: "replace", Old: "quick brown", New: "slow red", OldLine: 1, NewLine: 1},
+				{Type: "equal", Old: " fox.", New: " fox.", OldLine: 1, NewLine: 1},
+			},
+		},
+		{
+			name: "line breaks within a paragraph are ignored",
+			old:  "one two\nthree",
+			new:  "one two three",
+			hunks: []textHunk{
+				{Type: "equal", Old: "one two\nthree", New: "one two three", OldLine: 1, NewLine: 1},
+			},
+		},
+		{
+			name: "line numbers",
+			old:  "a\n\nb\nc",
+			new:  "a\n\nb\nd\ne",
+			hunks: []textHunk{
+				{Type: "equal", Old: "a\n\nb\n", New: "a\n\nb\n", OldLine: 1, NewLine: 1},
+				{Type: "replace", Old: "c", New: "d\ne", OldLine: 4, NewLine: 4},
+			},
+		},
+		{
+			name: "comment only",
+			old:  "x % old\ny",
+			new:  "x % new\ny",
+			hunks: []textHunk{
+				{Type: "equal", Old: "x ", New: "x ", OldLine: 1, NewLine: 1},
+				{Type: "replace", Old: "% old", New: "% new", OldLine: 1, NewLine: 1, CommentOnly: true},
+				{Type: "equal", Old: "\ny", New: "\ny", OldLine: 1, NewLine: 1},
+			},
+		},
+		{
+			name: "environment",
+			old:  `\begin{figure}x\end{figure}`,
+			new:  `\begin{table}x\end{table}`,
+			hunks: []textHunk{
+				{Type: "replace", Old: `\begin{figure}`, New: `\begin{table}`, OldLine: 1, NewLine: 1},
+				{Type: "equal", Old: "x", New: "x", OldLine: 1, NewLine: 1},
+				{Type: "replace", Old: `\end{figure}`, New: `\end{table}`, OldLine: 1, NewLine: 1},
+			},
+		},
+		{
+			name: "added file",
+			old:  "",
+			new:  "new\n",
+			hunks: []textHunk{
+				{Type: "insert", Old: "", New: "new\n", OldLine: 1, NewLine: 1},
+			},
+		},
+		{
+			name: "deleted paragraph",
+			old:  "a\n\nb",
+			new:  "a",
+			hunks: []textHunk{
+				{Type: "equal", Old: "a", New: "a", OldLine: 1, NewLine: 1},
+				{Type: "delete", Old: "\n\nb", New: "", OldLine: 1, NewLine: 1},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hunks, err := wordDiff(context.Background(), test.old, test.new)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(hunks, test.hunks) {
+				t.Errorf("got hunks\n%+v\nwant\n%+v", hunks, test.hunks)
+			}
+		})
+	}
+}